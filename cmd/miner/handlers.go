@@ -1,8 +1,10 @@
 package main
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"time"
 
 	"github.com/zakkbob/go-blockchain/internal/blockchain"
 	"github.com/zakkbob/go-blockchain/internal/gossip"
@@ -14,6 +16,16 @@ func (app *application) handler(m gossip.ReceivedMessage) {
 		return
 	}
 
+	if m.Type == msgHello {
+		app.helloHandler(m)
+		return
+	}
+
+	if !app.isPeer(m.RemoteAddr) {
+		app.logger.Info("Message received before handshake", "remoteAddr", m.RemoteAddr, "type", m.Type)
+		return
+	}
+
 	rebroadcast := false
 
 	switch m.Type {
@@ -21,6 +33,8 @@ func (app *application) handler(m gossip.ReceivedMessage) {
 		rebroadcast = app.newBlockHandler(m)
 	case msgNewTransaction:
 		rebroadcast = app.newTransactionHandler(m)
+	case msgGetBlock:
+		app.getBlockHandler(m)
 	default:
 		app.logger.Error("Unknown message received", "message", m)
 	}
@@ -33,6 +47,51 @@ func (app *application) handler(m gossip.ReceivedMessage) {
 	}
 }
 
+func (app *application) isPeer(remoteAddr string) bool {
+	app.peersMu.Lock()
+	defer app.peersMu.Unlock()
+	_, ok := app.peers[remoteAddr]
+	return ok
+}
+
+// disconnectHandler forgets a peer once its connection has closed, so it is
+// no longer trusted or asked for blocks
+func (app *application) disconnectHandler(remoteAddr string) {
+	app.peersMu.Lock()
+	delete(app.peers, remoteAddr)
+	app.peersMu.Unlock()
+
+	app.blockRequests.Forget(remoteAddr)
+}
+
+func (app *application) helloHandler(m gossip.ReceivedMessage) {
+	var h helloMessage
+
+	err := json.Unmarshal(m.Data, &h)
+	if err != nil {
+		app.serverError(m, err)
+		return
+	}
+
+	if h.NetworkID != app.params.NetworkID {
+		app.logger.Info("Peer is on a different network, disconnecting", "remoteAddr", m.RemoteAddr, "networkID", h.NetworkID)
+		app.node.Disconnect(m.RemoteAddr)
+		return
+	}
+
+	if h.Genesis != app.ledger.GenesisHash() {
+		app.logger.Info("Peer has a different genesis block, disconnecting", "remoteAddr", m.RemoteAddr, "genesis", hex.EncodeToString(h.Genesis[:]))
+		app.node.Disconnect(m.RemoteAddr)
+		return
+	}
+
+	app.peersMu.Lock()
+	app.peers[m.RemoteAddr] = struct{}{}
+	app.peersMu.Unlock()
+
+	app.syncs.Go(func() { app.syncPeer(m.RemoteAddr) })
+}
+
 func (app *application) newTransactionHandler(m gossip.ReceivedMessage) bool {
 	var tx blockchain.Transaction
 
@@ -47,24 +106,55 @@ func (app *application) newTransactionHandler(m gossip.ReceivedMessage) bool {
 		return false
 	}
 
+	if err = app.txpool.Add(tx); err != nil {
+		app.logger.Info("Transaction rejected", "remoteAddr", m.RemoteAddr, "error", err)
+		return false
+	}
+
 	app.logger.Info("New transaction received", "remoteAddr", m.RemoteAddr, "transaction", tx.String())
-	app.txpool.Add(tx)
 	return true
 }
 
 func (app *application) newBlockHandler(m gossip.ReceivedMessage) bool {
 	var b blockchain.Block
 
+	// Too large to ever be valid, so don't spend time decoding it
+	if len(m.Data) > app.params.MaxBlockSize {
+		app.logger.Info("Block rejected", "remoteAddr", m.RemoteAddr, "error", blockchain.ErrBlockTooLarge)
+		return false
+	}
+
 	err := json.Unmarshal(m.Data, &b)
 	if err != nil {
 		app.serverError(m, err)
 		return false
 	}
 
+	// Don't bother with the body if the header's proof-of-work is invalid
+	if err = b.BlockHeader.VerifyHash(); err != nil {
+		app.logger.Info("Block rejected", "remoteAddr", m.RemoteAddr, "error", err)
+		return false
+	}
+
 	err = app.ledger.AddBlock(b)
 	var epbnf blockchain.ErrPrevBlockNotFound
-	if errors.As(err, &epbnf) {
-		app.logger.Info("Block rejected", "remoteAddr", m.RemoteAddr, "error", err)
+	if errors.Is(err, blockchain.ErrKnownBlock) {
+		return false
+	} else if errors.As(err, &epbnf) {
+		// Its parent can't be checked yet, so its proof-of-work is all that
+		// stops anyone filling the pool with blocks which are free to make
+		if b.Difficulty < app.ledger.MinOrphanDifficulty() {
+			app.logger.Info("Orphan block rejected", "remoteAddr", m.RemoteAddr, "error", errOrphanTooEasy)
+			return false
+		}
+
+		// Hold on to it and ask the sender for whatever we're missing, it is
+		// only passed on once it connects
+		if app.orphans.Add(b) {
+			missing := app.orphans.MissingAncestor(b.Hash())
+			app.logger.Info("Orphan block received, requesting ancestor", "remoteAddr", m.RemoteAddr, "missing", hex.EncodeToString(missing[:]))
+			app.requestBlock(m.RemoteAddr, missing)
+		}
 		return false
 	} else if err != nil {
 		app.serverError(m, err)
@@ -72,5 +162,203 @@ func (app *application) newBlockHandler(m gossip.ReceivedMessage) bool {
 	}
 
 	app.logger.Info("New block received", "remoteAddr", m.RemoteAddr)
+	app.connectOrphans(b.Hash())
 	return true
 }
+
+// connectOrphans adds any orphans which descend from the block with hash, now
+// that it is in the ledger
+func (app *application) connectOrphans(hash [32]byte) {
+	queue := [][32]byte{hash}
+
+	for len(queue) > 0 {
+		children := app.orphans.Children(queue[0])
+		queue = queue[1:]
+
+		for _, child := range children {
+			if err := app.ledger.AddBlock(child); err != nil {
+				app.logger.Info("Orphan block rejected", "error", err)
+				continue
+			}
+
+			app.logger.Info("Orphan block connected", "hash", child.Hash())
+			app.node.Broadcast(gossip.Message{
+				Type: msgNewBlock,
+				Data: child,
+			})
+			queue = append(queue, child.Hash())
+		}
+	}
+}
+
+func (app *application) requestBlock(remoteAddr string, hash [32]byte) {
+	if !app.blockRequests.Allow(remoteAddr, time.Now()) {
+		app.logger.Info("Too many block requests, not requesting", "remoteAddr", remoteAddr, "hash", hex.EncodeToString(hash[:]))
+		return
+	}
+
+	err := app.node.Send(remoteAddr, gossip.Message{
+		Type: msgGetBlock,
+		Data: getBlockMessage{Hash: hash},
+	})
+	if err != nil {
+		app.logger.Info("Failed to request block", "remoteAddr", remoteAddr, "error", err)
+	}
+}
+
+// getBlockHandler sends a block the peer is missing back to it alone
+func (app *application) getBlockHandler(m gossip.ReceivedMessage) {
+	var req getBlockMessage
+
+	err := json.Unmarshal(m.Data, &req)
+	if err != nil {
+		app.serverError(m, err)
+		return
+	}
+
+	b, ok := app.ledger.Block(req.Hash)
+	if !ok {
+		return
+	}
+
+	err = app.node.Send(m.RemoteAddr, gossip.Message{
+		Type: msgNewBlock,
+		Data: b,
+	})
+	if err != nil {
+		app.logger.Info("Failed to send block", "remoteAddr", m.RemoteAddr, "error", err)
+	}
+}
+
+var (
+	errHandshakeIncomplete = errors.New("handshake not completed")
+	errUnknownRequest      = errors.New("unknown request")
+	errOrphanTooEasy       = errors.New("orphan block difficulty is too low to be on any chain we could follow")
+)
+
+// requestHandler answers the requests peers make while syncing their chain
+func (app *application) requestHandler(r gossip.ReceivedRequest) (any, error) {
+	if !app.isPeer(r.RemoteAddr) {
+		return nil, errHandshakeIncomplete
+	}
+
+	switch r.Type {
+	case reqGetHead:
+		return app.getHeadHandler(), nil
+	case reqGetHeaders:
+		return app.getHeadersHandler(r)
+	case reqGetBlocks:
+		return app.getBlocksHandler(r)
+	default:
+		return nil, errUnknownRequest
+	}
+}
+
+func (app *application) getHeadHandler() headInfo {
+	return headInfo{
+		Hash:   app.ledger.HeadHash(),
+		Length: app.ledger.Length(),
+		Work:   app.ledger.Work(),
+	}
+}
+
+// getHeadersHandler sends up to maxHeadersPerRequest headers following the
+// locator, stopping early if the response would be larger than a block may be
+func (app *application) getHeadersHandler(r gossip.ReceivedRequest) ([]blockchain.BlockHeader, error) {
+	var req getHeadersRequest
+
+	if err := json.Unmarshal(r.Data, &req); err != nil {
+		return nil, err
+	}
+
+	headers := app.ledger.HeadersAfter(req.Locator, maxHeadersPerRequest)
+	space := app.params.NewBlockSpace(0)
+
+	for i, h := range headers {
+		size := h.Size()
+		if i > 0 && !space.Fits(size) {
+			return headers[:i], nil
+		}
+		space.Add(size)
+	}
+
+	return headers, nil
+}
+
+// getBlocksHandler sends the requested blocks, stopping at the first unknown
+// one or once the response would be larger than a block may be. At least
+// one block is always sent if it is known, so the peer can make progress.
+func (app *application) getBlocksHandler(r gossip.ReceivedRequest) ([]blockchain.Block, error) {
+	var req getBlocksRequest
+
+	if err := json.Unmarshal(r.Data, &req); err != nil {
+		return nil, err
+	}
+
+	blocks := []blockchain.Block{}
+	space := app.params.NewBlockSpace(0)
+
+	for _, hash := range req.Hashes {
+		b, ok := app.ledger.Block(hash)
+		if !ok {
+			break
+		}
+
+		size := b.Size()
+		if len(blocks) > 0 && !space.Fits(size) {
+			break
+		}
+
+		blocks = append(blocks, b)
+		space.Add(size)
+	}
+
+	return blocks, nil
+}
+
+// ledgerEventHandler keeps the txpool and miner in step with the best chain
+func (app *application) ledgerEventHandler(e blockchain.Event) {
+	switch e := e.(type) {
+	case blockchain.BlockDisconnected:
+		// Payments in an abandoned fork shouldn't need resubmitting
+		app.txpool.Restore(e.Block)
+	case blockchain.BlockConnected:
+		// Mining these again would make them execute twice
+		app.txpool.RemoveConfirmed(e.Block)
+	case blockchain.NewHead:
+		// Balances and nonces have changed, so some pending transactions may
+		// no longer be affordable, and parked ones may now be ready
+		if dropped := app.txpool.Revalidate(); dropped > 0 {
+			app.logger.Info("Dropped invalid transactions from pool", "dropped", dropped, "pool", app.txpool.Size())
+		}
+
+		if len(e.Disconnected) > 0 {
+			app.logger.Info("Chain reorganised", "disconnected", len(e.Disconnected), "connected", len(e.Connected), "pool", app.txpool.Size())
+		}
+
+		// No time should be spent on a block which could no longer become the
+		// head, but mining only starts once synced. The new block is built in
+		// the background, as the ledger waits for its handlers.
+		select {
+		case <-app.synced:
+		default:
+			return
+		}
+
+		app.requestMiningRestart()
+	}
+}
+
+// poolTransactionHandler restarts mining when a transaction arrives which pays
+// enough to be in the next block, so its fee isn't missed. Building a block
+// checks every pending transaction, so it is done in the background and
+// transactions arriving together share one restart.
+func (app *application) poolTransactionHandler(tx blockchain.Transaction) {
+	select {
+	case <-app.synced:
+	default:
+		return
+	}
+
+	app.requestMiningRestart()
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"log/slog"
 	"testing"
+	"time"
 
 	"github.com/zakkbob/go-blockchain/internal/blockchain"
 	"github.com/zakkbob/go-blockchain/internal/gossip"
+	"github.com/zakkbob/go-blockchain/internal/orphanpool"
 	"github.com/zakkbob/go-blockchain/internal/txpool"
 )
 
@@ -12,6 +15,9 @@ func TestNewTransactionHandler(t *testing.T) {
 	addr1 := blockchain.MustGenerateTestAddress(t)
 	addr2 := blockchain.MustGenerateTestAddress(t)
 
+	ledger, _ := blockchain.MustCreateTestLedger(t)
+	blockchain.MustAddNewTestBlock(t, ledger, []blockchain.Transaction{}, addr1.PublicKey())
+
 	tests := []struct {
 		name         string
 		tx           blockchain.Transaction
@@ -19,12 +25,17 @@ func TestNewTransactionHandler(t *testing.T) {
 	}{
 		{
 			name:         "valid transaction",
-			tx:           addr1.NewTransaction(addr2.PublicKey(), 10),
+			tx:           addr1.NewTransaction(addr2.PublicKey(), 10, 0, 0),
 			expectedSize: 1,
 		},
 		{
 			name:         "transaction with 0 value",
-			tx:           addr1.NewTransaction(addr2.PublicKey(), 0),
+			tx:           addr1.NewTransaction(addr2.PublicKey(), 0, 0, 0),
+			expectedSize: 0,
+		},
+		{
+			name:         "unaffordable transaction",
+			tx:           addr2.NewTransaction(addr1.PublicKey(), 10, 0, 0),
 			expectedSize: 0,
 		},
 		{
@@ -44,7 +55,7 @@ func TestNewTransactionHandler(t *testing.T) {
 			app := application{
 				logger: CreateTestLogger(t),
 				config: CreateTestConfig(t),
-				txpool: txpool.Pool{},
+				txpool: txpool.NewPool(ledger.Params(), ledger, maxPoolTransactions, maxPoolBytes, maxPoolAge),
 			}
 
 			msg := gossip.CreateReceivedMessage(t, msgNewTransaction, "test :D", tt.tx)
@@ -59,6 +70,38 @@ func TestNewTransactionHandler(t *testing.T) {
 	}
 }
 
+func TestNewTransactionHandlerReplacement(t *testing.T) {
+	sender := blockchain.MustGenerateTestAddress(t)
+	receiver := blockchain.MustGenerateTestAddress(t)
+
+	ledger, _ := blockchain.MustCreateTestLedger(t)
+	blockchain.MustAddNewTestBlock(t, ledger, []blockchain.Transaction{}, sender.PublicKey())
+
+	app := application{
+		logger: CreateTestLogger(t),
+		config: CreateTestConfig(t),
+		txpool: txpool.NewPool(ledger.Params(), ledger, maxPoolTransactions, maxPoolBytes, maxPoolAge),
+	}
+
+	stuck := sender.NewTransaction(receiver.PublicKey(), 5, 0, 0)
+	cheap := sender.NewTransaction(receiver.PublicKey(), 4, 0, 0)
+	replacement := sender.NewTransaction(receiver.PublicKey(), 5, 1, 0)
+
+	if !app.newTransactionHandler(gossip.CreateReceivedMessage(t, msgNewTransaction, "test :D", stuck)) {
+		t.Fatal("transaction should be accepted")
+	}
+	if app.newTransactionHandler(gossip.CreateReceivedMessage(t, msgNewTransaction, "test :D", cheap)) {
+		t.Error("replacement without a higher fee should not be gossiped")
+	}
+	if !app.newTransactionHandler(gossip.CreateReceivedMessage(t, msgNewTransaction, "test :D", replacement)) {
+		t.Error("replacement should be gossiped")
+	}
+
+	if app.txpool.Size() != 1 || !app.txpool.Has(replacement.Hash()) {
+		t.Error("replacement should evict the stuck transaction")
+	}
+}
+
 func TestNewBlockHandler(t *testing.T) {
 	addr1 := blockchain.MustGenerateTestAddress(t)
 	addr2 := blockchain.MustGenerateTestAddress(t)
@@ -66,17 +109,18 @@ func TestNewBlockHandler(t *testing.T) {
 	ledger, genesis := blockchain.MustCreateTestLedger(t)
 
 	app := application{
-		logger: CreateTestLogger(t),
-		config: CreateTestConfig(t),
-		ledger: ledger,
+		logger:  CreateTestLogger(t),
+		config:  CreateTestConfig(t),
+		params:  ledger.Params(),
+		ledger:  ledger,
+		node:    CreateTestNode(t, slog.DiscardHandler),
+		orphans: orphanpool.New(10, time.Hour),
 	}
 
-	block := blockchain.NewBlock(genesis.Hash(), []blockchain.Transaction{}, 3, addr1.PublicKey())
-	block.Mine()
+	block := blockchain.NewTestBlock(t, genesis, []blockchain.Transaction{}, 0, addr1.PublicKey())
 
-	tx := addr1.NewTransaction(addr2.PublicKey(), 5)
-	block2 := blockchain.NewBlock(block.Hash(), []blockchain.Transaction{tx}, 3, addr2.PublicKey())
-	block2.Mine()
+	tx := addr1.NewTransaction(addr2.PublicKey(), 5, 0, 0)
+	block2 := blockchain.NewTestBlock(t, &block, []blockchain.Transaction{tx}, 0, addr2.PublicKey())
 
 	msg1 := gossip.CreateReceivedMessage(t, msgNewBlock, "test :D", block)
 	msg2 := gossip.CreateReceivedMessage(t, msgNewBlock, "test :D", block2)
@@ -88,4 +132,271 @@ func TestNewBlockHandler(t *testing.T) {
 		t.Fatal("Ermm, blocks should've been added!")
 	}
 
+	// Oversized blocks are rejected before being decoded
+	block3 := blockchain.NewTestBlock(t, &block2, []blockchain.Transaction{}, 0, addr1.PublicKey())
+	msg3 := gossip.CreateReceivedMessage(t, msgNewBlock, "test :D", block3)
+	app.params.MaxBlockSize = len(msg3.Data) - 1
+	app.newBlockHandler(msg3)
+
+	if ledger.Length() != 3 {
+		t.Error("oversized block should be rejected")
+	}
+
+}
+
+func TestNewBlockHandlerOrphan(t *testing.T) {
+	miner := blockchain.MustGenerateTestAddress(t)
+
+	ledger, genesis := blockchain.MustCreateTestLedger(t)
+
+	app := application{
+		logger:  CreateTestLogger(t),
+		config:  CreateTestConfig(t),
+		params:  ledger.Params(),
+		ledger:  ledger,
+		node:    CreateTestNode(t, slog.DiscardHandler),
+		orphans: orphanpool.New(10, time.Hour),
+	}
+
+	block1 := blockchain.NewTestBlock(t, genesis, []blockchain.Transaction{}, 0, miner.PublicKey())
+	block2 := blockchain.NewTestBlock(t, &block1, []blockchain.Transaction{}, 0, miner.PublicKey())
+	block3 := blockchain.NewTestBlock(t, &block2, []blockchain.Transaction{}, 0, miner.PublicKey())
+
+	for _, b := range []blockchain.Block{block3, block2} {
+		if app.newBlockHandler(gossip.CreateReceivedMessage(t, msgNewBlock, "test :D", b)) {
+			t.Error("orphans should not be rebroadcast")
+		}
+	}
+	if app.orphans.Size() != 2 || ledger.Length() != 1 {
+		t.Fatal("blocks without a parent should be held as orphans")
+	}
+	if app.orphans.MissingAncestor(block3.Hash()) != block1.Hash() {
+		t.Error("the first block should be the missing ancestor")
+	}
+
+	app.newBlockHandler(gossip.CreateReceivedMessage(t, msgNewBlock, "test :D", block1))
+
+	if ledger.Length() != 4 || ledger.HeadHash() != block3.Hash() {
+		t.Errorf("orphans should be connected once their parent arrives, length is %d", ledger.Length())
+	}
+	if app.orphans.Size() != 0 {
+		t.Error("connected orphans should be removed from the pool")
+	}
+}
+
+func TestNewBlockHandlerOrphanDifficulty(t *testing.T) {
+	miner := blockchain.MustGenerateTestAddress(t)
+
+	params := blockchain.NewTestParams()
+	params.Genesis.Difficulty = 4
+	if err := params.Genesis.Mine(); err != nil {
+		t.Fatal(err)
+	}
+	ledger, err := blockchain.NewLedger(params, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := application{
+		logger:  CreateTestLogger(t),
+		config:  CreateTestConfig(t),
+		params:  params,
+		ledger:  ledger,
+		node:    CreateTestNode(t, slog.DiscardHandler),
+		orphans: orphanpool.New(10, time.Hour),
+	}
+
+	// Neither has a parent in the ledger, but only one is within a retarget
+	// of the chain's difficulty
+	unknown := blockchain.NewGenesisBlock(0)
+	easy := blockchain.NewTestBlock(t, &unknown, []blockchain.Transaction{}, 1, miner.PublicKey())
+	plausible := blockchain.NewTestBlock(t, &unknown, []blockchain.Transaction{}, 2, miner.PublicKey())
+
+	app.newBlockHandler(gossip.CreateReceivedMessage(t, msgNewBlock, "test :D", easy))
+	if app.orphans.Size() != 0 {
+		t.Error("orphan with too low a difficulty should not be held")
+	}
+
+	app.newBlockHandler(gossip.CreateReceivedMessage(t, msgNewBlock, "test :D", plausible))
+	if app.orphans.Size() != 1 {
+		t.Error("orphan within a retarget of the chain's difficulty should be held")
+	}
+}
+
+func TestHelloHandler(t *testing.T) {
+	ledger, genesis := blockchain.MustCreateTestLedger(t)
+
+	networkID := ledger.Params().NetworkID
+
+	tests := []struct {
+		name      string
+		networkID uint32
+		genesis   [32]byte
+		wantPeer  bool
+	}{
+		{
+			name:      "same genesis",
+			networkID: networkID,
+			genesis:   genesis.Hash(),
+			wantPeer:  true,
+		},
+		{
+			name:      "different genesis",
+			networkID: networkID,
+			genesis:   [32]byte{1},
+			wantPeer:  false,
+		},
+		{
+			name:      "different network",
+			networkID: networkID + 1,
+			genesis:   genesis.Hash(),
+			wantPeer:  false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := application{
+				// Accepted peers are synced with in the background, which may
+				// log after the test ends
+				logger: slog.New(slog.DiscardHandler),
+				config: CreateTestConfig(t),
+				params: ledger.Params(),
+				ledger: ledger,
+				node:   CreateTestNode(t, slog.DiscardHandler),
+				peers:  map[string]struct{}{},
+			}
+
+			msg := gossip.CreateReceivedMessage(t, msgHello, "test :D", helloMessage{NetworkID: tt.networkID, Genesis: tt.genesis})
+			app.helloHandler(msg)
+
+			if app.isPeer("test :D") != tt.wantPeer {
+				t.Errorf("peer should be accepted: %t", tt.wantPeer)
+			}
+		})
+	}
+}
+
+func TestDisconnectHandler(t *testing.T) {
+	ledger, genesis := blockchain.MustCreateTestLedger(t)
+
+	app := application{
+		logger: slog.New(slog.DiscardHandler),
+		config: CreateTestConfig(t),
+		params: ledger.Params(),
+		ledger: ledger,
+		node:   CreateTestNode(t, slog.DiscardHandler),
+		peers:  map[string]struct{}{},
+	}
+
+	app.helloHandler(gossip.CreateReceivedMessage(t, msgHello, "test :D", helloMessage{NetworkID: ledger.Params().NetworkID, Genesis: genesis.Hash()}))
+	if !app.isPeer("test :D") {
+		t.Fatal("peer should be accepted")
+	}
+
+	app.disconnectHandler("test :D")
+	if app.isPeer("test :D") {
+		t.Error("disconnected peer should be forgotten")
+	}
+}
+
+func TestLedgerEventHandlerReorg(t *testing.T) {
+	sender := blockchain.MustGenerateTestAddress(t)
+	receiver := blockchain.MustGenerateTestAddress(t)
+	other := blockchain.MustGenerateTestAddress(t)
+
+	ledger, _ := blockchain.MustCreateTestLedger(t)
+	block1 := blockchain.MustAddNewTestBlock(t, ledger, []blockchain.Transaction{}, sender.PublicKey())
+
+	// Mining hasn't started, so only the pool is updated
+	app := application{
+		logger: CreateTestLogger(t),
+		config: CreateTestConfig(t),
+		params: ledger.Params(),
+		ledger: ledger,
+		txpool: txpool.NewPool(ledger.Params(), ledger, maxPoolTransactions, maxPoolBytes, maxPoolAge),
+		synced: make(chan struct{}),
+	}
+	ledger.Subscribe(app.ledgerEventHandler)
+
+	tx := sender.NewTransaction(receiver.PublicKey(), 1, 1, 0)
+	blockA2 := blockchain.NewTestBlock(t, block1, []blockchain.Transaction{tx}, 0, sender.PublicKey())
+	blockB2 := blockchain.NewTestBlock(t, block1, []blockchain.Transaction{}, 0, other.PublicKey())
+	blockB3 := blockchain.NewTestBlock(t, &blockB2, []blockchain.Transaction{}, 0, other.PublicKey())
+
+	blockchain.MustAddTestBlock(t, ledger, blockA2)
+	if app.txpool.Size() != 0 {
+		t.Fatal("pool should be empty before the reorg")
+	}
+
+	blockchain.MustAddTestBlock(t, ledger, blockB2)
+	blockchain.MustAddTestBlock(t, ledger, blockB3)
+
+	txs := app.txpool.Snapshot()
+	if len(txs) != 1 || txs[0].Hash() != tx.Hash() {
+		t.Fatalf("transaction from the abandoned fork should be returned to the pool, got %d transactions", len(txs))
+	}
+}
+
+func TestLedgerEventHandlerNewHead(t *testing.T) {
+	sender := blockchain.MustGenerateTestAddress(t)
+
+	ledger, _ := blockchain.MustCreateTestLedger(t)
+
+	// There is no miner, so the block must not be built while the ledger
+	// waits for the handler
+	app := application{
+		logger:        CreateTestLogger(t),
+		config:        CreateTestConfig(t),
+		params:        ledger.Params(),
+		ledger:        ledger,
+		txpool:        txpool.NewPool(ledger.Params(), ledger, maxPoolTransactions, maxPoolBytes, maxPoolAge),
+		synced:        make(chan struct{}),
+		restartMining: make(chan struct{}, 1),
+	}
+	ledger.Subscribe(app.ledgerEventHandler)
+	app.markSynced()
+
+	blockchain.MustAddNewTestBlock(t, ledger, []blockchain.Transaction{}, sender.PublicKey())
+
+	if len(app.restartMining) != 1 {
+		t.Error("a new head should request a mining restart")
+	}
+}
+
+func TestLedgerEventHandlerConfirmed(t *testing.T) {
+	sender := blockchain.MustGenerateTestAddress(t)
+	receiver := blockchain.MustGenerateTestAddress(t)
+	other := blockchain.MustGenerateTestAddress(t)
+
+	ledger, _ := blockchain.MustCreateTestLedger(t)
+	block1 := blockchain.MustAddNewTestBlock(t, ledger, []blockchain.Transaction{}, sender.PublicKey())
+
+	app := application{
+		logger:  CreateTestLogger(t),
+		config:  CreateTestConfig(t),
+		params:  ledger.Params(),
+		ledger:  ledger,
+		node:    CreateTestNode(t, slog.DiscardHandler),
+		txpool:  txpool.NewPool(ledger.Params(), ledger, maxPoolTransactions, maxPoolBytes, maxPoolAge),
+		orphans: orphanpool.New(maxOrphans, maxOrphanAge),
+		synced:  make(chan struct{}),
+	}
+	ledger.Subscribe(app.ledgerEventHandler)
+
+	confirmed := sender.NewTransaction(receiver.PublicKey(), 1, 1, 0)
+	pending := sender.NewTransaction(receiver.PublicKey(), 1, 1, 1)
+	app.txpool.Add(confirmed)
+	app.txpool.Add(pending)
+
+	// A peer mines the first transaction
+	b := blockchain.NewTestBlock(t, block1, []blockchain.Transaction{confirmed}, 0, other.PublicKey())
+	app.newBlockHandler(gossip.CreateReceivedMessage(t, msgNewBlock, "test :D", b))
+
+	if ledger.HeadHash() != b.Hash() {
+		t.Fatal("block should be accepted")
+	}
+	if app.txpool.Has(confirmed.Hash()) || !app.txpool.Has(pending.Hash()) {
+		t.Error("only the confirmed transaction should be removed from the pool")
+	}
 }
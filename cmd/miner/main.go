@@ -2,30 +2,63 @@ package main
 
 import (
 	"crypto/rand"
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/zakkbob/go-blockchain/internal/blockchain"
+	"github.com/zakkbob/go-blockchain/internal/blockstore"
 	"github.com/zakkbob/go-blockchain/internal/gossip"
 	"github.com/zakkbob/go-blockchain/internal/miner"
+	"github.com/zakkbob/go-blockchain/internal/orphanpool"
 	"github.com/zakkbob/go-blockchain/internal/txpool"
 )
 
+const (
+	maxOrphans   = 100
+	maxOrphanAge = 20 * time.Minute
+
+	maxPoolTransactions = 5000           // Default for -txpoolcount
+	maxPoolBytes        = 16 << 20       // Default for -txpoolbytes
+	maxPoolAge          = 72 * time.Hour // Default for -txexpiry
+
+	poolFileName = "mempool.json" // Where pending transactions are kept in the data directory over a restart
+)
+
 type config struct {
 	debug bool
 }
 
 type application struct {
 	config           config
+	params           *blockchain.ChainParams
 	address          blockchain.Address
 	miner            *miner.Miner
 	logger           *slog.Logger
 	ledger           *blockchain.Ledger
 	node             *gossip.Node
-	txpool           txpool.Pool
+	txpool           *txpool.Pool
+	orphans          *orphanpool.Pool
 	receivedMessages map[[32]byte]struct{}
+
+	peers   map[string]struct{} // Peers which have shown they share our genesis block
+	peersMu sync.Mutex
+
+	synced     chan struct{} // Closed once the initial sync is complete
+	syncedOnce sync.Once
+	syncs      sync.WaitGroup // Syncs with peers still running, which add blocks to the ledger
+
+	miningMu      sync.Mutex
+	restartMining chan struct{} // Holds a pending request to restart mining, see requestMiningRestart
+
+	blockRequests requestLimiter // Limits how often each peer is asked for missing blocks
 }
 
 type peersFlag []string
@@ -40,19 +73,62 @@ func (p *peersFlag) Set(value string) error {
 }
 
 var port int
-var difficulty int
+var network string
+var genesisPath string
+var dataDir string
+var poolCount int
+var poolBytes int
+var poolExpiry time.Duration
 var peers peersFlag
 
 func main() {
 	flag.IntVar(&port, "port", 4000, "API server port")
-	flag.IntVar(&difficulty, "difficulty", 10, "Mining difficulty")
+	flag.StringVar(&network, "network", "testnet", "Network to join (mainnet, testnet or regtest)")
+	flag.StringVar(&genesisPath, "genesis", "", "Genesis spec file, overrides the network's built-in genesis")
 	flag.Var(&peers, "peer", "Peers (can be used multiple times)")
+	flag.StringVar(&dataDir, "datadir", "", "Directory to store the chain in (keeps it in memory if empty)")
+	flag.IntVar(&poolCount, "txpoolcount", maxPoolTransactions, "Most pending transactions to hold before evicting the lowest paying")
+	flag.IntVar(&poolBytes, "txpoolbytes", maxPoolBytes, "Most bytes of pending transactions to hold before evicting the lowest paying")
+	flag.DurationVar(&poolExpiry, "txexpiry", maxPoolAge, "How long a transaction may wait to be mined before it is dropped")
 
 	flag.Parse()
 
 	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
 
-	ledger, err := blockchain.NewLedger(difficulty)
+	var err error
+
+	if poolCount <= 0 || poolBytes <= 0 {
+		logger.Error("Transaction pool limits must be positive", "txpoolcount", poolCount, "txpoolbytes", poolBytes)
+		os.Exit(1)
+	}
+	if poolExpiry <= 0 {
+		logger.Error("Transaction expiry must be positive", "txexpiry", poolExpiry)
+		os.Exit(1)
+	}
+
+	params, ok := blockchain.NetworkParams(network)
+	if !ok {
+		logger.Error("Unknown network", "network", network)
+		os.Exit(1)
+	}
+	if genesisPath != "" {
+		params.Genesis, err = blockchain.LoadGenesisSpec(genesisPath)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+
+	var store blockchain.Store
+	if dataDir != "" {
+		store, err = blockstore.Open(filepath.Join(dataDir, "blocks"))
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+
+	ledger, err := blockchain.NewLedger(params, store)
 	if err != nil {
 		logger.Error(err.Error())
 		os.Exit(1)
@@ -61,6 +137,11 @@ func main() {
 	node := &gossip.Node{
 		Addr:   fmt.Sprintf(":%d", port),
 		Logger: logger,
+		Handshake: &gossip.Message{
+			Type: msgHello,
+			Data: helloMessage{NetworkID: params.NetworkID, Genesis: ledger.GenesisHash()},
+		},
+		MaxMessageSize: params.MaxBlockSize + maxMessageOverhead,
 	}
 
 	address, err := blockchain.GenerateAddress(rand.Reader)
@@ -68,28 +149,83 @@ func main() {
 		logger.Error(err.Error())
 		os.Exit(1)
 	}
-	miner := miner.NewMiner(address.PublicKey())
+	miner := miner.NewMiner(address.PublicKey(), params)
 
 	app := application{
 		config: config{
 			debug: true,
 		},
+		params:           params,
 		address:          address,
 		logger:           logger,
 		ledger:           ledger,
 		miner:            miner,
 		node:             node,
-		txpool:           txpool.Pool{},
+		txpool:           txpool.NewPool(params, ledger, poolCount, poolBytes, poolExpiry),
+		orphans:          orphanpool.New(maxOrphans, maxOrphanAge),
 		receivedMessages: map[[32]byte]struct{}{},
+		peers:            map[string]struct{}{},
+		synced:           make(chan struct{}),
+		restartMining:    make(chan struct{}, 1),
+	}
+	node.RequestHandler = app.requestHandler
+	node.OnDisconnect = app.disconnectHandler
+
+	// Payments which were pending when the node last stopped
+	var poolPath string
+	if dataDir != "" {
+		poolPath = filepath.Join(dataDir, poolFileName)
+		loaded, err := app.txpool.Load(poolPath)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		logger.Info("Loaded pending transactions", "loaded", loaded)
+	}
+
+	ledger.Subscribe(app.ledgerEventHandler)
+	app.txpool.Subscribe(app.poolTransactionHandler)
+
+	// With nobody to sync from, the local chain is as good as it gets
+	if len(peers) == 0 {
+		app.markSynced()
 	}
 
 	go app.processMinedBlocks()
+	go app.processMiningRestarts()
 
-	logger.Info("starting server", "port", port, "hash", ledger.Head().Hash())
+	logger.Info("starting server", "port", port, "network", network, "genesis", ledger.GenesisHash(), "hash", ledger.Head().Hash(), "length", ledger.Length(), "supply", ledger.Supply())
 
-	err = node.BootstrapAndListen(peers, app.handler)
-	if err != nil {
-		logger.Error(err.Error())
-		os.Exit(1)
+	go func() {
+		err := node.BootstrapAndListen(peers, app.handler)
+		if err != nil && !errors.Is(err, gossip.ErrNodeClosed) {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	sig := <-stop
+
+	logger.Info("shutting down", "signal", sig.String(), "pool", app.txpool.Size())
+
+	// Nothing may change the pool or the chain once they are saved, so stop
+	// gossip and the syncs it started first
+	if err := node.Close(); err != nil {
+		logger.Error("Could not stop listening", "error", err)
+	}
+	app.syncs.Wait()
+	app.miner.Stop()
+
+	if poolPath != "" {
+		if err := app.txpool.Save(poolPath); err != nil {
+			logger.Error("Could not save pending transactions", "error", err)
+		}
+	}
+	if store != nil {
+		if err := store.Close(); err != nil {
+			logger.Error(err.Error())
+		}
 	}
 }
@@ -1,6 +1,56 @@
 package main
 
+import "github.com/holiman/uint256"
+
+// maxMessageOverhead is room for the message envelope around a payload, so
+// the largest valid block can always be sent
+const maxMessageOverhead = 1024
+
 var (
+	msgHello          = "hello"
 	msgNewBlock       = "newBlock"
 	msgNewTransaction = "newTransaction"
+	msgGetBlock       = "getBlock"
 )
+
+// helloMessage is sent as a handshake when connecting to a peer
+type helloMessage struct {
+	NetworkID uint32   `json:"network_id"`
+	Genesis   [32]byte `json:"genesis"`
+}
+
+// getBlockMessage asks a peer to send a block it has, usually the missing
+// parent of an orphan
+type getBlockMessage struct {
+	Hash [32]byte `json:"hash"`
+}
+
+// Requests, which are answered by the peer they are made of
+var (
+	reqGetHead    = "getHead"
+	reqGetHeaders = "getHeaders"
+	reqGetBlocks  = "getBlocks"
+)
+
+// maxHeadersPerRequest is the most headers sent in response to a single
+// getHeaders request
+const maxHeadersPerRequest = 1000
+
+// headInfo describes the best chain a node knows of
+type headInfo struct {
+	Hash   [32]byte     `json:"hash"`
+	Length int          `json:"length"`
+	Work   *uint256.Int `json:"work"`
+}
+
+// getHeadersRequest asks for the headers of the peer's best chain which follow
+// the first locator hash it knows
+type getHeadersRequest struct {
+	Locator [][32]byte `json:"locator"`
+}
+
+// getBlocksRequest asks for blocks by hash. The peer sends as many as fit in a
+// message, in the order they were asked for.
+type getBlocksRequest struct {
+	Hashes [][32]byte `json:"hashes"`
+}
@@ -1,54 +1,127 @@
 package main
 
 import (
+	"slices"
+
 	"github.com/zakkbob/go-blockchain/internal/blockchain"
 	"github.com/zakkbob/go-blockchain/internal/gossip"
 )
 
+// updateMiningTarget starts mining a new block on the best chain
 func (app *application) updateMiningTarget() {
+	app.miningMu.Lock()
+	defer app.miningMu.Unlock()
+
 	b := app.constructNextBlock()
-	app.miner.Mine(b)
+
+	if err := app.miner.Mine(b); err != nil {
+		app.logger.Error("Could not start mining", "error", err)
+	}
+}
+
+// requestMiningRestart asks for mining to restart with a new block, without
+// waiting for it to. Requests made while one is already waiting are merged
+// into it, so a burst of transactions builds one block rather than one each.
+func (app *application) requestMiningRestart() {
+	select {
+	case app.restartMining <- struct{}{}:
+	default:
+	}
+}
+
+// processMiningRestarts restarts mining each time it is requested
+func (app *application) processMiningRestarts() {
+	for range app.restartMining {
+		app.updateMiningTarget()
+	}
 }
 
 func (app *application) constructNextBlock() blockchain.Block {
 	var (
-		prevHash   = app.ledger.HeadHash()
-		difficulty = app.ledger.CalculateFutureDifficulty()
-		balances   = app.ledger.Balances()
-		candidates = app.txpool.Get(100)
-		txs        = make([]blockchain.Transaction, 0, 100)
+		template = app.ledger.NextBlockTemplate()
+		balances = template.Balances
+		pending  = app.txpool.Snapshot()
+		maxTxs   = app.params.MaxBlockTransactions - 1 // leave room for the coinbase
+		txs      = make([]blockchain.Transaction, 0, maxTxs)
+		space    = app.params.NewBlockSpace(blockchain.CoinbaseBlockSize(template.PrevBlock, template.Height, template.Difficulty, app.address.PublicKey()))
+		fees     uint64
 	)
 
-	for _, tx := range candidates {
-		if err := tx.Verify(); err != nil { //sanity check
-			panic("oh no")
+	// The pool only accepts valid transactions, so this should never find
+	// any, but one would make the whole block invalid
+	pending = slices.DeleteFunc(pending, func(tx blockchain.Transaction) bool {
+		if err := tx.Verify(); err != nil {
+			app.logger.Error("Invalid transaction in pool, dropping it", "transaction", tx.String(), "error", err)
+			app.txpool.Remove(tx.Hash())
+			return true
 		}
+		return false
+	})
 
-		if balances.Get(tx.Sender) < tx.Value {
-			continue
+	// The pool gives the highest fee rate first. A sender's later nonces may
+	// come ahead of earlier ones, so keep passing over the candidates until
+	// nothing else fits.
+
+	for progress := true; progress; {
+		progress = false
+		deferred := make([]blockchain.Transaction, 0, len(pending))
+
+		for _, tx := range pending {
+			txSize := tx.Size()
+
+			switch {
+			case len(txs) == maxTxs, !space.Fits(txSize), tx.Nonce > balances.Nonce(tx.Sender):
+				deferred = append(deferred, tx)
+			case tx.Nonce < balances.Nonce(tx.Sender), balances.Get(tx.Sender) < tx.Cost():
+				// Can't be included on top of this template, but the template
+				// may already be out of date, so dropping it is left to
+				// Revalidate
+			default:
+				balances.Decrease(tx.Sender, tx.Cost())
+				balances.Increase(tx.Receiver, tx.Value)
+				balances.IncrementNonce(tx.Sender)
+
+				txs = append(txs, tx)
+				space.Add(txSize)
+				fees += tx.Fee
+				progress = true
+			}
 		}
 
-		balances.Decrease(tx.Sender, tx.Value)
-		balances.Increase(tx.Receiver, tx.Value)
+		pending = deferred
+	}
+
+	coinbase := blockchain.NewCoinbase(app.address.PublicKey(), app.params.BlockReward(template.Height)+fees, template.Height, nil)
+	txs = append([]blockchain.Transaction{coinbase}, txs...)
 
-		txs = append(candidates, tx)
+	b := blockchain.NewBlock(template.PrevBlock, txs, template.Difficulty, app.address.PublicKey())
+
+	// Blocks found in quick succession may otherwise share a timestamp
+	if b.Timestamp <= template.MedianTimePast {
+		b.Timestamp = template.MedianTimePast + 1
 	}
 
-	return blockchain.NewBlock(prevHash, txs, difficulty, app.address.PublicKey())
+	return b
 }
 
 func (app *application) processMinedBlocks() {
-	var b *blockchain.Block
-	for {
-		app.updateMiningTarget()
-
-		b = <-app.miner.MinedBlocks
+	// Blocks mined on an outdated chain would only be thrown away
+	app.waitForSync(initialSyncTimeout)
+	app.updateMiningTarget()
 
+	for b := range app.miner.MinedBlocks {
 		if err := app.ledger.AddBlock(*b); err != nil {
 			app.logger.Error("Locally mined block is invalid", "error", err)
+			app.updateMiningTarget()
 			continue
 		}
 
+		// Mining restarts when the head changes, but a block found just as
+		// another arrived may not have become the head
+		if app.ledger.HeadHash() != b.Hash() {
+			app.updateMiningTarget()
+		}
+
 		app.node.Broadcast(gossip.Message{
 			Type: msgNewBlock,
 			Data: b,
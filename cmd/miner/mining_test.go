@@ -0,0 +1,371 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/zakkbob/go-blockchain/internal/blockchain"
+	"github.com/zakkbob/go-blockchain/internal/miner"
+	"github.com/zakkbob/go-blockchain/internal/txpool"
+)
+
+func TestConstructNextBlock(t *testing.T) {
+	sender := blockchain.MustGenerateTestAddress(t)
+	receiver := blockchain.MustGenerateTestAddress(t)
+
+	ledger, _ := blockchain.MustCreateTestLedger(t)
+	blockchain.MustAddNewTestBlock(t, ledger, []blockchain.Transaction{}, sender.PublicKey())
+
+	app := application{
+		logger:  CreateTestLogger(t),
+		config:  CreateTestConfig(t),
+		params:  ledger.Params(),
+		address: receiver,
+		ledger:  ledger,
+		txpool:  txpool.NewPool(ledger.Params(), ledger, maxPoolTransactions, maxPoolBytes, maxPoolAge),
+	}
+
+	// Nonce 1 pays the most, but can only be included after nonce 0
+	app.txpool.Add(sender.NewTransaction(receiver.PublicKey(), 1, 1, 0))
+	app.txpool.Add(sender.NewTransaction(receiver.PublicKey(), 1, 3, 1))
+	app.txpool.Add(sender.NewTransaction(receiver.PublicKey(), 1, 2, 2))
+	// Leaves a gap, so is parked in the pool
+	parked := sender.NewTransaction(receiver.PublicKey(), 1, 0, 4)
+	app.txpool.Add(parked)
+	// Spends more than the sender will have left
+	overspend := sender.NewTransaction(receiver.PublicKey(), 5, 0, 3)
+	if err := app.txpool.Add(overspend); !errors.Is(err, txpool.ErrInsufficientBalance) {
+		t.Errorf("Add should return %v, not %v", txpool.ErrInsufficientBalance, err)
+	}
+
+	b := app.constructNextBlock()
+
+	if len(b.Transactions) != 4 {
+		t.Fatalf("block should contain a coinbase and 3 transactions, got %d", len(b.Transactions))
+	}
+	if coinbase := b.Transactions[0]; !coinbase.IsCoinbase() || coinbase.Value != 10+6 || b.Height() != 2 {
+		t.Errorf("coinbase should claim the reward and fees at height 2, got %s", coinbase.String())
+	}
+	for i, tx := range b.Transactions[1:] {
+		if tx.Nonce != uint64(i) {
+			t.Errorf("transaction %d should have nonce %d, got %d", i, i, tx.Nonce)
+		}
+	}
+
+	// Included transactions stay in the pool until they are confirmed
+	if app.txpool.Size() != 4 || !app.txpool.Has(parked.Hash()) {
+		t.Errorf("included and parked transactions should stay in the pool")
+	}
+
+	b.Mine()
+	if err := ledger.AddBlock(b); err != nil {
+		t.Fatalf("constructed block should be valid: %v", err)
+	}
+	blockchain.AssertAddressBalance(t, ledger, receiver, 3+6+10)
+}
+
+func TestConstructNextBlockInvalidTransaction(t *testing.T) {
+	sender := blockchain.MustGenerateTestAddress(t)
+	receiver := blockchain.MustGenerateTestAddress(t)
+
+	ledger, _ := blockchain.MustCreateTestLedger(t)
+	blockchain.MustAddNewTestBlock(t, ledger, []blockchain.Transaction{}, sender.PublicKey())
+
+	app := application{
+		logger:  CreateTestLogger(t),
+		config:  CreateTestConfig(t),
+		params:  ledger.Params(),
+		address: receiver,
+		ledger:  ledger,
+		txpool:  txpool.NewPool(ledger.Params(), ledger, maxPoolTransactions, maxPoolBytes, maxPoolAge),
+	}
+
+	// The pool leaves checking signatures to whoever adds to it
+	forged := sender.NewTransaction(receiver.PublicKey(), 1, 1, 0)
+	forged.Signature[0] ^= 1
+	app.txpool.Add(forged)
+
+	b := app.constructNextBlock()
+
+	if len(b.Transactions) != 1 {
+		t.Errorf("invalid transaction should be left out, got %d transactions", len(b.Transactions))
+	}
+	if app.txpool.Has(forged.Hash()) {
+		t.Error("invalid transaction should be dropped from the pool")
+	}
+}
+
+func TestConstructNextBlockStaleTransaction(t *testing.T) {
+	sender := blockchain.MustGenerateTestAddress(t)
+	receiver := blockchain.MustGenerateTestAddress(t)
+
+	ledger, _ := blockchain.MustCreateTestLedger(t)
+	block1 := blockchain.MustAddNewTestBlock(t, ledger, []blockchain.Transaction{}, sender.PublicKey())
+
+	// The pool checks against a chain which hasn't seen the transaction
+	// confirmed yet
+	behind, _ := blockchain.MustCreateTestLedger(t)
+	blockchain.MustAddTestBlock(t, behind, *block1)
+
+	app := application{
+		logger:  CreateTestLogger(t),
+		config:  CreateTestConfig(t),
+		params:  ledger.Params(),
+		address: receiver,
+		ledger:  ledger,
+		txpool:  txpool.NewPool(ledger.Params(), behind, maxPoolTransactions, maxPoolBytes, maxPoolAge),
+	}
+
+	tx := sender.NewTransaction(receiver.PublicKey(), 1, 1, 0)
+	if err := app.txpool.Add(tx); err != nil {
+		t.Fatalf("Add should not return an error: %v", err)
+	}
+	blockchain.MustAddNewTestBlock(t, ledger, []blockchain.Transaction{tx}, sender.PublicKey())
+
+	b := app.constructNextBlock()
+
+	if len(b.Transactions) != 1 {
+		t.Errorf("transaction confirmed on the template's chain should be skipped, got %d transactions", len(b.Transactions)-1)
+	}
+	if !app.txpool.Has(tx.Hash()) {
+		t.Error("skipped transaction should be left for the pool to drop")
+	}
+}
+
+func TestConstructNextBlockLimits(t *testing.T) {
+	sender := blockchain.MustGenerateTestAddress(t)
+	receiver := blockchain.MustGenerateTestAddress(t)
+
+	tests := []struct {
+		name   string
+		params func(p *blockchain.ChainParams, prev [32]byte, txSize int)
+		want   int
+	}{
+		{
+			name:   "transaction count",
+			params: func(p *blockchain.ChainParams, prev [32]byte, txSize int) { p.MaxBlockTransactions = 3 },
+			want:   2,
+		},
+		{
+			name: "block size",
+			params: func(p *blockchain.ChainParams, prev [32]byte, txSize int) {
+				b := blockchain.NewBlock(prev, []blockchain.Transaction{blockchain.NewCoinbase(receiver.PublicKey(), math.MaxUint64, 2, nil)}, 0, receiver.PublicKey())
+				b.Nonce = math.MaxUint64
+				p.MaxBlockSize = b.Size() + 2*(txSize+1)
+			},
+			want: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			txs := make([]blockchain.Transaction, 4)
+			for i := range txs {
+				txs[i] = sender.NewTransaction(receiver.PublicKey(), 1, 0, uint64(i))
+			}
+
+			params := blockchain.NewTestParams()
+			ledger, err := blockchain.NewLedger(params, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			prev := blockchain.MustAddNewTestBlock(t, ledger, []blockchain.Transaction{}, sender.PublicKey())
+
+			// The ledger shares params, so it enforces the same limits
+			tt.params(params, prev.Hash(), txs[0].Size())
+
+			app := application{
+				logger:  CreateTestLogger(t),
+				config:  CreateTestConfig(t),
+				params:  params,
+				address: receiver,
+				ledger:  ledger,
+				txpool:  txpool.NewPool(params, ledger, maxPoolTransactions, maxPoolBytes, maxPoolAge),
+			}
+			for _, tx := range txs {
+				app.txpool.Add(tx)
+			}
+
+			b := app.constructNextBlock()
+
+			if len(b.Transactions)-1 != tt.want {
+				t.Fatalf("block should contain %d transactions, got %d", tt.want, len(b.Transactions)-1)
+			}
+			if app.txpool.Size() != len(txs) {
+				t.Errorf("transactions which didn't fit should stay in the pool")
+			}
+
+			b.Mine()
+			if err := ledger.AddBlock(b); err != nil {
+				t.Fatalf("constructed block should be valid: %v", err)
+			}
+		})
+	}
+}
+
+func TestMiningRestartsOnNewHead(t *testing.T) {
+	sender := blockchain.MustGenerateTestAddress(t)
+	receiver := blockchain.MustGenerateTestAddress(t)
+	other := blockchain.MustGenerateTestAddress(t)
+
+	ledger, _ := blockchain.MustCreateTestLedger(t)
+	block1 := blockchain.MustAddNewTestBlock(t, ledger, []blockchain.Transaction{}, sender.PublicKey())
+
+	app := &application{
+		logger:  CreateTestLogger(t),
+		config:  CreateTestConfig(t),
+		params:  ledger.Params(),
+		address: receiver,
+		ledger:  ledger,
+		miner:   miner.NewMiner(receiver.PublicKey(), ledger.Params()),
+		txpool:  txpool.NewPool(ledger.Params(), ledger, maxPoolTransactions, maxPoolBytes, maxPoolAge),
+		synced:  make(chan struct{}),
+	}
+	defer app.miner.Stop()
+	app.restartMining = make(chan struct{}, 1)
+	go app.processMiningRestarts()
+	defer close(app.restartMining)
+
+	ledger.Subscribe(app.ledgerEventHandler)
+	app.markSynced()
+
+	tx := sender.NewTransaction(receiver.PublicKey(), 1, 1, 0)
+	app.txpool.Add(tx)
+	app.updateMiningTarget()
+
+	// Another miner confirms the transaction first
+	block2 := blockchain.NewTestBlock(t, block1, []blockchain.Transaction{tx}, 0, other.PublicKey())
+	blockchain.MustAddTestBlock(t, ledger, block2)
+
+	deadline := time.After(time.Second)
+	for {
+		select {
+		case b := <-app.miner.MinedBlocks:
+			// Blocks found before the restart may still arrive
+			if b.PrevBlock != block2.Hash() {
+				continue
+			}
+			if len(b.Transactions) != 1 {
+				t.Errorf("transaction confirmed by the new head should not be mined again")
+			}
+			return
+		case <-deadline:
+			t.Fatal("mining should restart on the new head")
+		}
+	}
+}
+
+func TestMiningKeepsPendingTransactions(t *testing.T) {
+	sender := blockchain.MustGenerateTestAddress(t)
+	receiver := blockchain.MustGenerateTestAddress(t)
+	other := blockchain.MustGenerateTestAddress(t)
+
+	ledger, _ := blockchain.MustCreateTestLedger(t)
+	blockchain.MustAddNewTestBlock(t, ledger, []blockchain.Transaction{}, sender.PublicKey())
+
+	app := &application{
+		logger:  CreateTestLogger(t),
+		config:  CreateTestConfig(t),
+		params:  ledger.Params(),
+		address: receiver,
+		ledger:  ledger,
+		miner:   miner.NewMiner(receiver.PublicKey(), ledger.Params()),
+		txpool:  txpool.NewPool(ledger.Params(), ledger, maxPoolTransactions, maxPoolBytes, maxPoolAge),
+		synced:  make(chan struct{}),
+	}
+	defer app.miner.Stop()
+	app.restartMining = make(chan struct{}, 1)
+	go app.processMiningRestarts()
+	defer close(app.restartMining)
+
+	ledger.Subscribe(app.ledgerEventHandler)
+	app.markSynced()
+
+	app.txpool.Add(sender.NewTransaction(receiver.PublicKey(), 1, 1, 0))
+	app.updateMiningTarget()
+
+	// The new head doesn't include the transaction being mined
+	head := blockchain.MustAddNewTestBlock(t, ledger, []blockchain.Transaction{}, other.PublicKey())
+
+	deadline := time.After(time.Second)
+	for {
+		select {
+		case b := <-app.miner.MinedBlocks:
+			if b.PrevBlock != head.Hash() {
+				continue
+			}
+			if len(b.Transactions) != 2 {
+				t.Errorf("transaction should still be mined on the new head")
+			}
+			return
+		case <-deadline:
+			t.Fatal("mining should restart on the new head")
+		}
+	}
+}
+
+func TestMiningRestartsOnNewTransaction(t *testing.T) {
+	sender := blockchain.MustGenerateTestAddress(t)
+	receiver := blockchain.MustGenerateTestAddress(t)
+
+	ledger, _ := blockchain.MustCreateTestLedger(t)
+	blockchain.MustAddNewTestBlock(t, ledger, []blockchain.Transaction{}, sender.PublicKey())
+
+	app := &application{
+		logger:  CreateTestLogger(t),
+		config:  CreateTestConfig(t),
+		params:  ledger.Params(),
+		address: receiver,
+		ledger:  ledger,
+		miner:   miner.NewMiner(receiver.PublicKey(), ledger.Params()),
+		txpool:  txpool.NewPool(ledger.Params(), ledger, maxPoolTransactions, maxPoolBytes, maxPoolAge),
+		synced:  make(chan struct{}),
+	}
+	defer app.miner.Stop()
+	app.restartMining = make(chan struct{}, 1)
+	go app.processMiningRestarts()
+	defer close(app.restartMining)
+
+	app.txpool.Subscribe(app.poolTransactionHandler)
+	app.markSynced()
+
+	app.updateMiningTarget()
+
+	tx := sender.NewTransaction(receiver.PublicKey(), 1, 1, 0)
+	if err := app.txpool.Add(tx); err != nil {
+		t.Fatalf("Add should not return an error: %v", err)
+	}
+
+	deadline := time.After(time.Second)
+	for {
+		select {
+		case b := <-app.miner.MinedBlocks:
+			// Blocks found before the restart may still arrive
+			if len(b.Transactions) == 1 {
+				continue
+			}
+			if b.Transactions[1].Hash() != tx.Hash() {
+				t.Errorf("new transaction should be mined")
+			}
+			return
+		case <-deadline:
+			t.Fatal("mining should restart with the new transaction")
+		}
+	}
+}
+
+func TestRequestMiningRestart(t *testing.T) {
+	app := &application{
+		restartMining: make(chan struct{}, 1),
+	}
+
+	// Nothing is restarting mining, so the requests pile up into one
+	for range 100 {
+		app.requestMiningRestart()
+	}
+	if len(app.restartMining) != 1 {
+		t.Errorf("requests should be merged into one, got %d", len(app.restartMining))
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// blockRequestInterval is how long to wait before asking the same peer for
+// another missing block, so a peer sending a stream of orphans can't make us
+// flood it (or whoever it spoofs) with requests
+const blockRequestInterval = time.Second
+
+// requestLimiter allows one request per peer every blockRequestInterval. The
+// zero value is ready to use.
+type requestLimiter struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+// Allow reports whether a request may be sent to remoteAddr at now, and if so
+// counts it
+func (l *requestLimiter) Allow(remoteAddr string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if last, ok := l.last[remoteAddr]; ok && now.Sub(last) < blockRequestInterval {
+		return false
+	}
+
+	if l.last == nil {
+		l.last = map[string]time.Time{}
+	}
+	l.last[remoteAddr] = now
+	return true
+}
+
+// Forget drops what is known about remoteAddr, once it has disconnected
+func (l *requestLimiter) Forget(remoteAddr string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.last, remoteAddr)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRequestLimiter(t *testing.T) {
+	var l requestLimiter
+	now := time.Now()
+
+	if !l.Allow("a", now) || !l.Allow("b", now) {
+		t.Fatal("first request to each peer should be allowed")
+	}
+	if l.Allow("a", now.Add(blockRequestInterval/2)) {
+		t.Error("second request within the interval should not be allowed")
+	}
+	if !l.Allow("a", now.Add(blockRequestInterval)) {
+		t.Error("request after the interval should be allowed")
+	}
+
+	l.Forget("b")
+	if !l.Allow("b", now) {
+		t.Error("request to a forgotten peer should be allowed")
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/holiman/uint256"
+	"github.com/zakkbob/go-blockchain/internal/blockchain"
+)
+
+const (
+	syncRequestTimeout = 30 * time.Second // How long a peer has to answer each sync request
+	headersTimeout     = 10 * time.Minute // How long a peer has to send every header of its chain
+	initialSyncTimeout = time.Minute      // How long to wait for a bootstrap peer to sync from before mining anyway
+	blocksPerRequest   = 16               // Blocks asked for at once, small enough to spread a download between peers
+	maxDownloadPeers   = 8                // Most peers blocks are downloaded from at once
+)
+
+var (
+	errSyncStalled      = errors.New("peer claims more work but sent nothing new")
+	errNotEnoughWork    = errors.New("peer's headers have no more work than our chain")
+	errTooMuchWork      = errors.New("peer's headers have more work than it claimed")
+	errTooManyHeaders   = errors.New("peer sent more headers than its chain is long")
+	errDifficultyTooLow = errors.New("header difficulty is too low to be on any chain we could follow")
+	errUnexpectedData   = errors.New("peer sent an unexpected response")
+	errMissingBlocks    = errors.New("peer does not have the requested blocks")
+	errNoPeers          = errors.New("no peer could send the remaining blocks")
+)
+
+// request makes a sync request of a peer and decodes its response into v
+func (app *application) request(ctx context.Context, remoteAddr string, requestType string, data any, v any) error {
+	ctx, cancel := context.WithTimeout(ctx, syncRequestTimeout)
+	defer cancel()
+
+	res, err := app.node.Request(ctx, remoteAddr, requestType, data)
+	if err != nil {
+		return fmt.Errorf("%s request: %w", requestType, err)
+	}
+
+	if err := json.Unmarshal(res.Data, v); err != nil {
+		return fmt.Errorf("%s response: %w", requestType, err)
+	}
+
+	return nil
+}
+
+// syncWith brings our chain up to the head a peer had when we asked, if it
+// has more work. The peer's headers are downloaded and checked first, so
+// bodies are only fetched for a chain worth having. Anything the peer finds
+// afterwards arrives through gossip.
+func (app *application) syncWith(remoteAddr string) error {
+	var head headInfo
+	if err := app.request(context.Background(), remoteAddr, reqGetHead, nil, &head); err != nil {
+		return err
+	}
+	if head.Work == nil {
+		return errUnexpectedData
+	}
+
+	if _, ok := app.ledger.Block(head.Hash); ok || app.ledger.Work().Cmp(head.Work) >= 0 {
+		return nil
+	}
+
+	app.logger.Info("Syncing with peer", "remoteAddr", remoteAddr, "length", app.ledger.Length(), "peerLength", head.Length)
+
+	headers, err := app.downloadHeaders(remoteAddr, head)
+	if err != nil {
+		return err
+	}
+
+	// The locator may have been older than where our chains diverge
+	for len(headers) > 0 {
+		if _, ok := app.ledger.Block(headers[0].Hash()); !ok {
+			break
+		}
+		headers = headers[1:]
+	}
+
+	return app.downloadBlocks(remoteAddr, headers)
+}
+
+// downloadHeaders fetches the headers of a peer's best chain from where it
+// diverges from ours, up to the head it advertised. The headers must link up
+// and have valid proof-of-work, and together must have more work than our
+// chain. As the peer could send headers forever, it is held to the length and
+// work it advertised, every header must be about as hard to mine as our own
+// blocks, and the whole download must finish within headersTimeout.
+func (app *application) downloadHeaders(remoteAddr string, head headInfo) ([]blockchain.BlockHeader, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), headersTimeout)
+	defer cancel()
+
+	var (
+		chain         []blockchain.BlockHeader
+		prev          [32]byte
+		work          *uint256.Int
+		maxHeaders    int
+		locator       = app.ledger.Locator()
+		minDifficulty = app.ledger.MinOrphanDifficulty()
+	)
+
+	for {
+		var headers []blockchain.BlockHeader
+		if err := app.request(ctx, remoteAddr, reqGetHeaders, getHeadersRequest{Locator: locator}, &headers); err != nil {
+			return nil, err
+		}
+		if len(headers) == 0 {
+			break
+		}
+
+		// The chain must start from a block we have, or we could never add it
+		if work == nil {
+			prev = headers[0].PrevBlock
+			forkWork, ok := app.ledger.WorkAt(prev)
+			if !ok {
+				return nil, fmt.Errorf("first header: %w", blockchain.ErrHeaderNotLinked)
+			}
+			forkLength, _ := app.ledger.LengthAt(prev)
+			work, maxHeaders = forkWork, head.Length-forkLength
+		}
+
+		if len(chain)+len(headers) > maxHeaders {
+			return nil, errTooManyHeaders
+		}
+		if err := blockchain.VerifyHeaderChain(prev, headers); err != nil {
+			return nil, err
+		}
+		for i, h := range headers {
+			if h.Difficulty < minDifficulty {
+				return nil, fmt.Errorf("header %d: %w", len(chain)+i, errDifficultyTooLow)
+			}
+			work.Add(work, h.Work())
+		}
+		if work.Cmp(head.Work) > 0 {
+			return nil, errTooMuchWork
+		}
+
+		chain = append(chain, headers...)
+		prev = headers[len(headers)-1].Hash()
+
+		// Keep asking until there are none left, as a short response may
+		// only have been cut to fit in a message
+		if prev == head.Hash {
+			break
+		}
+		locator = [][32]byte{prev}
+	}
+
+	if len(chain) == 0 {
+		return nil, errSyncStalled
+	}
+	if work.Cmp(app.ledger.Work()) <= 0 {
+		return nil, errNotEnoughWork
+	}
+
+	return chain, nil
+}
+
+type blocksJob struct {
+	start   int // Position of the first block in the download
+	headers []blockchain.BlockHeader
+}
+
+type blocksResult struct {
+	blocksJob
+	remoteAddr string
+	blocks     []blockchain.Block
+	err        error // Set if the peer won't be asked for any more blocks
+}
+
+// downloadBlocks fetches the bodies of headers from several peers at once, and
+// adds them to the ledger in order as they arrive. Work a peer fails to do is
+// passed on to the others.
+func (app *application) downloadBlocks(origin string, headers []blockchain.BlockHeader) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Each worker takes a job before putting any back, so this never fills up
+	jobs := make(chan blocksJob, len(headers)/blocksPerRequest+1)
+	for start := 0; start < len(headers); start += blocksPerRequest {
+		jobs <- blocksJob{start: start, headers: headers[start:min(start+blocksPerRequest, len(headers))]}
+	}
+
+	results := make(chan blocksResult)
+	peers := app.downloadPeers(origin)
+	for _, remoteAddr := range peers {
+		go app.downloadWorker(ctx, remoteAddr, jobs, results)
+	}
+
+	received := map[int]blockchain.Block{}
+	next, active := 0, len(peers)
+
+	for next < len(headers) {
+		if active == 0 {
+			return errNoPeers
+		}
+
+		res := <-results
+		for i, b := range res.blocks {
+			received[res.start+i] = b
+		}
+
+		if res.err != nil {
+			active--
+			app.logger.Info("Stopped downloading blocks from peer", "remoteAddr", res.remoteAddr, "error", res.err)
+
+			// Sending bodies which don't match their headers is never honest
+			if errors.Is(res.err, blockchain.ErrHeaderMismatch) || errors.Is(res.err, blockchain.ErrMerkleRootMismatch) {
+				app.node.Disconnect(res.remoteAddr)
+			}
+		}
+
+		for {
+			b, ok := received[next]
+			if !ok {
+				break
+			}
+			delete(received, next)
+
+			err := app.ledger.AddBlock(b)
+			if err != nil && !errors.Is(err, blockchain.ErrKnownBlock) {
+				return fmt.Errorf("block %x: %w", b.Hash(), err)
+			}
+			next++
+		}
+	}
+
+	return nil
+}
+
+// downloadPeers returns the peers to download blocks from, starting with the
+// one being synced with, which is known to have them
+func (app *application) downloadPeers(origin string) []string {
+	app.peersMu.Lock()
+	defer app.peersMu.Unlock()
+
+	peers := []string{origin}
+	for remoteAddr := range app.peers {
+		if len(peers) == maxDownloadPeers {
+			break
+		}
+		if remoteAddr != origin {
+			peers = append(peers, remoteAddr)
+		}
+	}
+
+	return peers
+}
+
+// downloadWorker requests blocks from a peer until there are none left, or the
+// peer fails to send them. Blocks it didn't send are put back for another
+// worker.
+func (app *application) downloadWorker(ctx context.Context, remoteAddr string, jobs chan blocksJob, results chan<- blocksResult) {
+	for {
+		var job blocksJob
+		select {
+		case job = <-jobs:
+		case <-ctx.Done():
+			return
+		}
+
+		blocks, err := app.requestBlocks(ctx, remoteAddr, job.headers)
+		if len(blocks) < len(job.headers) {
+			jobs <- blocksJob{start: job.start + len(blocks), headers: job.headers[len(blocks):]}
+		}
+
+		select {
+		case results <- blocksResult{blocksJob: job, remoteAddr: remoteAddr, blocks: blocks, err: err}:
+		case <-ctx.Done():
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// requestBlocks asks a peer for the bodies of headers, and checks each is the
+// block its header describes. The blocks up to the first bad one are returned.
+func (app *application) requestBlocks(ctx context.Context, remoteAddr string, headers []blockchain.BlockHeader) ([]blockchain.Block, error) {
+	hashes := make([][32]byte, len(headers))
+	for i := range headers {
+		hashes[i] = headers[i].Hash()
+	}
+
+	var blocks []blockchain.Block
+	if err := app.request(ctx, remoteAddr, reqGetBlocks, getBlocksRequest{Hashes: hashes}, &blocks); err != nil {
+		return nil, err
+	}
+	if len(blocks) == 0 {
+		return nil, errMissingBlocks
+	}
+	if len(blocks) > len(headers) {
+		return nil, errUnexpectedData
+	}
+
+	for i := range blocks {
+		if err := blocks[i].VerifyBody(&headers[i]); err != nil {
+			return blocks[:i], err
+		}
+	}
+
+	return blocks, nil
+}
+
+// syncPeer syncs with a peer which has just completed the handshake. Peers
+// which fail to sync are dropped, as they are either misbehaving or too slow
+// to be useful.
+func (app *application) syncPeer(remoteAddr string) {
+	if err := app.syncWith(remoteAddr); err != nil {
+		app.logger.Info("Sync with peer failed, disconnecting", "remoteAddr", remoteAddr, "error", err)
+		app.node.Disconnect(remoteAddr)
+		return
+	}
+
+	app.logger.Info("Synced with peer", "remoteAddr", remoteAddr, "hash", app.ledger.HeadHash(), "length", app.ledger.Length())
+	app.markSynced()
+}
+
+// markSynced records that the initial sync is complete, so mining can start
+func (app *application) markSynced() {
+	app.syncedOnce.Do(func() { close(app.synced) })
+}
+
+// waitForSync blocks until the initial sync completes. If no peer has been
+// synced with before the timeout, the node mines on whatever chain it has.
+func (app *application) waitForSync(timeout time.Duration) {
+	select {
+	case <-app.synced:
+	case <-time.After(timeout):
+		app.logger.Warn("Initial sync timed out, mining on the local chain")
+		app.markSynced()
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zakkbob/go-blockchain/internal/blockchain"
+	"github.com/zakkbob/go-blockchain/internal/gossip"
+	"github.com/zakkbob/go-blockchain/internal/orphanpool"
+	"github.com/zakkbob/go-blockchain/internal/txpool"
+)
+
+// startSyncTestApp runs a node for ledger, connected to peers
+func startSyncTestApp(t *testing.T, ledger *blockchain.Ledger, params *blockchain.ChainParams, peers []string) *application {
+	t.Helper()
+
+	node := CreateTestNode(t, slog.DiscardHandler)
+	node.Handshake = &gossip.Message{
+		Type: msgHello,
+		Data: helloMessage{NetworkID: params.NetworkID, Genesis: ledger.GenesisHash()},
+	}
+
+	app := &application{
+		logger:  slog.New(slog.DiscardHandler),
+		config:  CreateTestConfig(t),
+		params:  params,
+		ledger:  ledger,
+		node:    node,
+		txpool:  txpool.NewPool(params, ledger, maxPoolTransactions, maxPoolBytes, maxPoolAge),
+		orphans: orphanpool.New(maxOrphans, maxOrphanAge),
+		peers:   map[string]struct{}{},
+		synced:  make(chan struct{}),
+	}
+	node.RequestHandler = app.requestHandler
+	node.OnDisconnect = app.disconnectHandler
+
+	StartTestNode(t, node, peers, app.handler)
+
+	return app
+}
+
+func TestSync(t *testing.T) {
+	miner := blockchain.MustGenerateTestAddress(t)
+	other := blockchain.MustGenerateTestAddress(t)
+
+	ahead, _ := blockchain.MustCreateTestLedger(t)
+	behind, genesis := blockchain.MustCreateTestLedger(t)
+
+	// A shorter fork, which should be abandoned
+	fork := blockchain.NewTestBlock(t, genesis, []blockchain.Transaction{}, 0, other.PublicKey())
+	blockchain.MustAddTestBlock(t, behind, fork)
+
+	for range 20 {
+		blockchain.MustAddNewTestBlock(t, ahead, []blockchain.Transaction{}, miner.PublicKey())
+	}
+
+	// Only a few blocks fit in each getBlocks response, so several are needed
+	params := *ahead.Params()
+	params.MaxBlockSize = 2000
+
+	a := startSyncTestApp(t, ahead, &params, nil)
+	b := startSyncTestApp(t, behind, behind.Params(), []string{a.node.ListenerAddr().String()})
+
+	select {
+	case <-b.synced:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sync should complete")
+	}
+
+	if behind.HeadHash() != ahead.HeadHash() {
+		t.Errorf("synced ledger should have the same head")
+	}
+	if behind.Length() != 21 {
+		t.Errorf("expected length of 21; got %d", behind.Length())
+	}
+
+	// Syncing the other way finds nothing to download
+	select {
+	case <-a.synced:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sync should complete")
+	}
+	if ahead.Length() != 21 {
+		t.Errorf("expected length of 21; got %d", ahead.Length())
+	}
+}
+
+func TestGetBlocksHandler(t *testing.T) {
+	miner := blockchain.MustGenerateTestAddress(t)
+
+	ledger, genesis := blockchain.MustCreateTestLedger(t)
+	block1 := blockchain.MustAddNewTestBlock(t, ledger, []blockchain.Transaction{}, miner.PublicKey())
+	block2 := blockchain.MustAddNewTestBlock(t, ledger, []blockchain.Transaction{}, miner.PublicKey())
+
+	params := *ledger.Params()
+
+	tests := []struct {
+		name         string
+		maxBlockSize int
+		hashes       [][32]byte
+		expected     [][32]byte
+	}{
+		{"all", params.MaxBlockSize, [][32]byte{genesis.Hash(), block1.Hash(), block2.Hash()}, [][32]byte{genesis.Hash(), block1.Hash(), block2.Hash()}},
+		{"stops at unknown", params.MaxBlockSize, [][32]byte{block1.Hash(), {1}, block2.Hash()}, [][32]byte{block1.Hash()}},
+		{"limited by size", block1.Size() + 1, [][32]byte{block1.Hash(), block2.Hash()}, [][32]byte{block1.Hash()}},
+		{"always one", 1, [][32]byte{block2.Hash(), block1.Hash()}, [][32]byte{block2.Hash()}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := params
+			params.MaxBlockSize = tt.maxBlockSize
+
+			app := application{
+				logger: CreateTestLogger(t),
+				params: &params,
+				ledger: ledger,
+			}
+
+			msg := gossip.CreateReceivedRequest(t, reqGetBlocks, "test :D", getBlocksRequest{Hashes: tt.hashes})
+			blocks, err := app.getBlocksHandler(msg)
+			if err != nil {
+				t.Fatalf("getBlocksHandler should not return an error: %v", err)
+			}
+
+			if len(blocks) != len(tt.expected) {
+				t.Fatalf("expected %d blocks; got %d", len(tt.expected), len(blocks))
+			}
+			for i, b := range blocks {
+				if b.Hash() != tt.expected[i] {
+					t.Errorf("block %d should be %x, not %x", i, tt.expected[i], b.Hash())
+				}
+			}
+		})
+	}
+}
+
+func TestGetHeadersHandler(t *testing.T) {
+	miner := blockchain.MustGenerateTestAddress(t)
+
+	ledger, genesis := blockchain.MustCreateTestLedger(t)
+	block1 := blockchain.MustAddNewTestBlock(t, ledger, []blockchain.Transaction{}, miner.PublicKey())
+	blockchain.MustAddNewTestBlock(t, ledger, []blockchain.Transaction{}, miner.PublicKey())
+
+	params := *ledger.Params()
+
+	tests := []struct {
+		name         string
+		maxBlockSize int
+		expected     int
+	}{
+		{"all", params.MaxBlockSize, 2},
+		{"limited by size", block1.BlockHeader.Size() + 1, 1},
+		{"always one", 1, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := params
+			params.MaxBlockSize = tt.maxBlockSize
+
+			app := application{
+				logger: CreateTestLogger(t),
+				params: &params,
+				ledger: ledger,
+			}
+
+			msg := gossip.CreateReceivedRequest(t, reqGetHeaders, "test :D", getHeadersRequest{Locator: [][32]byte{genesis.Hash()}})
+			headers, err := app.getHeadersHandler(msg)
+			if err != nil {
+				t.Fatalf("getHeadersHandler should not return an error: %v", err)
+			}
+
+			if len(headers) != tt.expected {
+				t.Fatalf("expected %d headers; got %d", tt.expected, len(headers))
+			}
+			if headers[0].Hash() != block1.Hash() {
+				t.Errorf("first header should be %x, not %x", block1.Hash(), headers[0].Hash())
+			}
+		})
+	}
+}
+
+// startBlockServer runs a node which answers sync requests from ledger,
+// without a handshake. handle may change the response to each request.
+func startBlockServer(t *testing.T, ledger *blockchain.Ledger, handle func(r gossip.ReceivedRequest, res any) (any, error)) string {
+	t.Helper()
+
+	server := &application{
+		logger: slog.New(slog.DiscardHandler),
+		params: ledger.Params(),
+		ledger: ledger,
+		peers:  map[string]struct{}{},
+	}
+
+	node := CreateTestNode(t, slog.DiscardHandler)
+	node.RequestHandler = func(r gossip.ReceivedRequest) (any, error) {
+		// Every connection is trusted, there is no handshake
+		server.peersMu.Lock()
+		server.peers[r.RemoteAddr] = struct{}{}
+		server.peersMu.Unlock()
+
+		res, err := server.requestHandler(r)
+		if err != nil || handle == nil {
+			return res, err
+		}
+		return handle(r, res)
+	}
+
+	StartTestNode(t, node, nil, func(gossip.ReceivedMessage) {})
+
+	return fmt.Sprintf("127.0.0.1:%d", node.ListenerAddr().(*net.TCPAddr).Port)
+}
+
+// startSyncClient connects a node for ledger to servers, treating each as a
+// peer which has completed the handshake
+func startSyncClient(t *testing.T, ledger *blockchain.Ledger, servers ...string) *application {
+	t.Helper()
+
+	app := &application{
+		logger:  slog.New(slog.DiscardHandler),
+		params:  ledger.Params(),
+		ledger:  ledger,
+		node:    CreateTestNode(t, slog.DiscardHandler),
+		orphans: orphanpool.New(maxOrphans, maxOrphanAge),
+		peers:   map[string]struct{}{},
+		synced:  make(chan struct{}),
+	}
+	for _, s := range servers {
+		app.peers[s] = struct{}{}
+	}
+
+	StartTestNode(t, app.node, servers, app.handler)
+
+	return app
+}
+
+// mustCreateTestChain returns two ledgers holding the same chain of length
+func mustCreateTestChain(t *testing.T, length int) (*blockchain.Ledger, *blockchain.Ledger) {
+	t.Helper()
+	miner := blockchain.MustGenerateTestAddress(t)
+
+	a, _ := blockchain.MustCreateTestLedger(t)
+	b, _ := blockchain.MustCreateTestLedger(t)
+	for range length - 1 {
+		block := blockchain.MustAddNewTestBlock(t, a, []blockchain.Transaction{}, miner.PublicKey())
+		blockchain.MustAddTestBlock(t, b, *block)
+	}
+
+	return a, b
+}
+
+func TestDownloadBlocks(t *testing.T) {
+	source, replica := mustCreateTestChain(t, 3*blocksPerRequest+1)
+	empty, _ := blockchain.MustCreateTestLedger(t)
+	headers := source.HeadersAfter([][32]byte{source.GenesisHash()}, maxHeadersPerRequest)
+
+	var mu sync.Mutex
+	served := map[string]int{}
+	count := func(name string) func(gossip.ReceivedRequest, any) (any, error) {
+		return func(r gossip.ReceivedRequest, res any) (any, error) {
+			mu.Lock()
+			served[name]++
+			mu.Unlock()
+
+			// Slow enough that the download is shared
+			time.Sleep(20 * time.Millisecond)
+			return res, nil
+		}
+	}
+
+	tampered := func(r gossip.ReceivedRequest, res any) (any, error) {
+		blocks := res.([]blockchain.Block)
+		for i := range blocks {
+			blocks[i].Transactions = nil
+		}
+		return blocks, nil
+	}
+
+	tests := []struct {
+		name         string
+		other        func() string
+		shared       bool // Both peers should have sent blocks
+		disconnected bool
+	}{
+		{"shared with honest peer", func() string { return startBlockServer(t, replica, count("other")) }, true, false},
+		{"peer without blocks", func() string { return startBlockServer(t, empty, nil) }, false, false},
+		{"peer sending tampered blocks", func() string { return startBlockServer(t, source, tampered) }, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			served = map[string]int{}
+			mu.Unlock()
+
+			origin := startBlockServer(t, source, count("origin"))
+			other := tt.other()
+
+			ledger, _ := blockchain.MustCreateTestLedger(t)
+			app := startSyncClient(t, ledger, origin, other)
+
+			if err := app.downloadBlocks(origin, headers); err != nil {
+				t.Fatalf("downloadBlocks should not return an error: %v", err)
+			}
+			if ledger.HeadHash() != source.HeadHash() {
+				t.Error("every block should be downloaded")
+			}
+
+			mu.Lock()
+			if tt.shared && (served["origin"] == 0 || served["other"] == 0) {
+				t.Errorf("blocks should be downloaded from both peers, got %v", served)
+			}
+			mu.Unlock()
+
+			err := app.node.Send(other, gossip.Message{Type: "ping"})
+			if disconnected := errors.Is(err, gossip.ErrUnknownPeer); disconnected != tt.disconnected {
+				t.Errorf("expected peer disconnected to be %t; got %t", tt.disconnected, disconnected)
+			}
+		})
+	}
+}
+
+func TestSyncInvalidHeaders(t *testing.T) {
+	source, _ := mustCreateTestChain(t, 5)
+
+	noChange := func(h []blockchain.BlockHeader) {}
+
+	tests := []struct {
+		name       string
+		change     func(headers []blockchain.BlockHeader)
+		changeHead func(head *headInfo)
+		wantErr    error
+	}{
+		{"invalid proof-of-work", func(h []blockchain.BlockHeader) { h[2].Difficulty = 30 }, nil, blockchain.ErrHashOutOfBounds},
+		{"broken chain", func(h []blockchain.BlockHeader) { h[2] = h[3] }, nil, blockchain.ErrHeaderNotLinked},
+		{"unknown start", func(h []blockchain.BlockHeader) { h[0].PrevBlock = [32]byte{1} }, nil, blockchain.ErrHeaderNotLinked},
+		{"longer than advertised", noChange, func(head *headInfo) { head.Length-- }, errTooManyHeaders},
+		{"more work than advertised", noChange, func(head *headInfo) { head.Work.SubUint64(head.Work, 1) }, errTooMuchWork},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			blocksRequested := false
+
+			server := startBlockServer(t, source, func(r gossip.ReceivedRequest, res any) (any, error) {
+				switch r.Type {
+				case reqGetHead:
+					if tt.changeHead != nil {
+						head := res.(headInfo)
+						tt.changeHead(&head)
+						return head, nil
+					}
+				case reqGetHeaders:
+					tt.change(res.([]blockchain.BlockHeader))
+				case reqGetBlocks:
+					mu.Lock()
+					blocksRequested = true
+					mu.Unlock()
+				}
+				return res, nil
+			})
+
+			ledger, _ := blockchain.MustCreateTestLedger(t)
+			app := startSyncClient(t, ledger, server)
+
+			if err := app.syncWith(server); !errors.Is(err, tt.wantErr) {
+				t.Errorf("syncWith should return %v, not %v", tt.wantErr, err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if blocksRequested {
+				t.Error("blocks should not be requested for invalid headers")
+			}
+			if ledger.Length() != 1 {
+				t.Errorf("no blocks should be added, got length %d", ledger.Length())
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"log/slog"
 	"testing"
+	"time"
 
 	"github.com/zakkbob/go-blockchain/internal/gossip"
 )
@@ -34,3 +35,16 @@ func CreateTestNode(t *testing.T, h slog.Handler) *gossip.Node {
 		Logger: slog.New(h),
 	}
 }
+
+// StartTestNode runs n, connected to peers, and waits until it is listening
+func StartTestNode(t *testing.T, n *gossip.Node, peers []string, handler func(gossip.ReceivedMessage)) {
+	t.Helper()
+
+	go n.BootstrapAndListen(peers, handler)
+
+	select {
+	case <-n.Ready():
+	case <-time.After(time.Second):
+		t.Fatal("node should start listening")
+	}
+}
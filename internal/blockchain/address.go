@@ -30,13 +30,18 @@ func (a *Address) sign(message []byte) []byte {
 	return ed25519.Sign(a.privateKey, message)
 }
 
-func (a *Address) NewTransaction(receiver ed25519.PublicKey, value uint64) Transaction {
-	hash := hashTransaction(a.publicKey, receiver, value)
+// NewTransaction signs a transfer of value to receiver, paying fee to the
+// miner that includes it. nonce must be the sender's next expected nonce
+// (see Balances.Nonce), otherwise the ledger will reject the transaction.
+func (a *Address) NewTransaction(receiver ed25519.PublicKey, value uint64, fee uint64, nonce uint64) Transaction {
+	hash := hashTransaction(a.publicKey, receiver, value, fee, nonce, nil)
 
 	return Transaction{
 		Sender:    a.publicKey,
 		Receiver:  receiver,
 		Value:     value,
+		Fee:       fee,
+		Nonce:     nonce,
 		Signature: a.sign(hash[:]),
 	}
 }
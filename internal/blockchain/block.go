@@ -2,55 +2,57 @@ package blockchain
 
 import (
 	"crypto/ed25519"
-	"crypto/sha256"
-	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"math"
-	"slices"
 	"time"
-
-	"github.com/holiman/uint256"
 )
 
 var (
-	ErrHashOutOfBounds = errors.New("hash is not within required boundaries")
+	ErrHashOutOfBounds     = errors.New("hash is not within required boundaries")
+	ErrMerkleRootMismatch  = errors.New("merkle root does not match transactions")
+	ErrMissingCoinbase     = errors.New("first transaction of a block must be a coinbase")
+	ErrBlockTooLarge       = errors.New("encoded block is larger than the chain allows")
+	ErrTooManyTransactions = errors.New("block has more transactions than the chain allows")
+	ErrHeaderMismatch      = errors.New("block does not match the expected header")
 )
 
-var pi, _ = uint256.FromDecimal("31415926535897932384626433832795028841971693993751058209749445923078164062862")
-
+// Block is a header plus the transactions (body) it commits to
 type Block struct {
-	Difficulty   int               `json:"difficulty"`
-	PrevBlock    [32]byte          `json:"previous_block"`
-	Nonce        uint64            `json:"nonce"`
-	Transactions []Transaction     `json:"transactions"`
-	Timestamp    int64             `json:"timestamp"`
-	Miner        ed25519.PublicKey `json:"miner"`
-	Genesis      bool              `json:"genesis"`
+	BlockHeader
+	Transactions []Transaction `json:"transactions"`
 }
 
 func NewGenesisBlock(difficulty int) Block {
 	return Block{
-		Difficulty:   difficulty,
-		PrevBlock:    [32]byte{},
+		BlockHeader: BlockHeader{
+			Version:    BlockVersion,
+			Difficulty: difficulty,
+			PrevBlock:  [32]byte{},
+			MerkleRoot: MerkleRoot(nil),
+			Nonce:      0,
+			Timestamp:  time.Now().Unix(),
+			Miner:      ed25519.PublicKey{},
+			Genesis:    true,
+		},
 		Transactions: []Transaction{},
-		Nonce:        0,
-		Timestamp:    time.Now().Unix(),
-		Miner:        ed25519.PublicKey{},
-		Genesis:      true,
 	}
 }
 
 func NewBlock(prevBlock [32]byte, txs []Transaction, difficulty int, miner ed25519.PublicKey) Block {
 	return Block{
-		Difficulty:   difficulty,
-		PrevBlock:    prevBlock,
+		BlockHeader: BlockHeader{
+			Version:    BlockVersion,
+			Difficulty: difficulty,
+			PrevBlock:  prevBlock,
+			MerkleRoot: MerkleRoot(txs),
+			Nonce:      0,
+			Timestamp:  time.Now().Unix(),
+			Miner:      miner,
+			Genesis:    false,
+		},
 		Transactions: txs,
-		Nonce:        0,
-		Timestamp:    time.Now().Unix(),
-		Miner:        miner,
-		Genesis:      false,
 	}
 }
 
@@ -63,28 +65,17 @@ func (b *Block) Clone() Block {
 	}
 
 	return Block{
-		Difficulty:   b.Difficulty,
-		PrevBlock:    b.PrevBlock,
+		BlockHeader:  b.BlockHeader.Clone(),
 		Transactions: newTxs,
-		Nonce:        b.Nonce,
-		Timestamp:    b.Timestamp,
-		Miner:        slices.Clone(b.Miner),
-		Genesis:      b.Genesis,
 	}
 }
 
-func (b *Block) uint256Hash() *uint256.Int {
-	hash := b.Hash()
-	uint256Hash := uint256.NewInt(0)
-	uint256Hash.SetBytes(hash[:])
-	return uint256Hash
-}
-
 func (b Block) String() string {
 	hash := b.uint256Hash()
 	return fmt.Sprintf(
-		"Hash: %s; Previous Block: %s; Difficulty: %d; Transactions: %d; Nonce: %d; Timestamp: %d; Mined By: %s; Genesis: %t; Hash Satisfies Difficulty: %t; Verified Transactions: %t",
+		"Hash: %s; Version: %d; Previous Block: %s; Difficulty: %d; Transactions: %d; Nonce: %d; Timestamp: %d; Mined By: %s; Genesis: %t; Hash Satisfies Difficulty: %t; Verified Transactions: %t",
 		hash.Dec(),
+		b.Version,
 		hex.EncodeToString(b.PrevBlock[:]),
 		b.Difficulty,
 		len(b.Transactions),
@@ -97,20 +88,35 @@ func (b Block) String() string {
 	)
 }
 
-func (b *Block) Hash() [32]byte {
-	txsHash := HashTransactions(b.Transactions)
-
-	data := b.PrevBlock[:]
-	data = append(data, txsHash[:]...)
-	data = append(data, []byte(b.Miner)...)
-	data = binary.LittleEndian.AppendUint64(data, uint64(b.Timestamp))
-	data = binary.LittleEndian.AppendUint64(data, uint64(b.Nonce))
-
-	return sha256.Sum256(data)
+// Height returns the block's position in its chain, which every block but
+// the genesis block commits to in its coinbase
+func (b *Block) Height() int {
+	if b.Genesis || len(b.Transactions) == 0 {
+		return 0
+	}
+	return int(b.Transactions[0].Nonce)
 }
 
+// VerifyTransactions checks the body matches the header and every transaction
+// is valid on its own. A genesis block's transactions are initial allocations,
+// which have no sender to sign them. Every other block starts with a coinbase.
 func (b *Block) VerifyTransactions() error {
-	for _, tx := range b.Transactions {
+	if MerkleRoot(b.Transactions) != b.MerkleRoot {
+		return ErrMerkleRootMismatch
+	}
+
+	if b.Genesis {
+		return nil
+	}
+
+	if len(b.Transactions) == 0 || !b.Transactions[0].IsCoinbase() {
+		return ErrMissingCoinbase
+	}
+	if err := b.Transactions[0].VerifyCoinbase(); err != nil {
+		return err
+	}
+
+	for _, tx := range b.Transactions[1:] {
 		if err := tx.Verify(); err != nil {
 			return err
 		}
@@ -119,33 +125,53 @@ func (b *Block) VerifyTransactions() error {
 
 }
 
-func (b *Block) VerifyHash() error {
-	hash := b.uint256Hash()
-
-	digits := 77 - b.Difficulty/3
-	divisor := math.Pow(2, float64(b.Difficulty%3))
-
-	lower := pi.Clone()
-	div := uint256.NewInt(10)
-	exp := uint256.NewInt(uint64(digits))
-
-	div.Exp(div, exp)
-	lower.Div(lower, div)
-	lower.Mul(lower, div)
+// VerifyBody checks the block is the one header describes, and its
+// transactions are the ones the header's Merkle root commits to. This is
+// enough to tell a body downloaded separately from its header hasn't been
+// tampered with, without validating the transactions themselves.
+func (b *Block) VerifyBody(header *BlockHeader) error {
+	if b.Hash() != header.Hash() {
+		return ErrHeaderMismatch
+	}
+	if MerkleRoot(b.Transactions) != header.MerkleRoot {
+		return ErrMerkleRootMismatch
+	}
+	return nil
+}
 
-	div.Div(div, uint256.NewInt(uint64(divisor)))
+// Size is the length of the block's JSON encoding
+func (b *Block) Size() int {
+	return encodedSize(b)
+}
 
-	upper := lower.Clone()
-	upper.Add(upper, div)
+// CoinbaseBlockSize is an upper bound on the encoded size of a block
+// containing only a coinbase paying miner, for counting the space left for
+// other transactions with a BlockSpace. The coinbase value and block nonce
+// aren't known until the block is built and mined, so the longest possible
+// values are assumed.
+func CoinbaseBlockSize(prevHash [32]byte, height int, difficulty int, miner ed25519.PublicKey) int {
+	coinbase := NewCoinbase(miner, math.MaxUint64, height, nil)
+	b := NewBlock(prevHash, []Transaction{coinbase}, difficulty, miner)
+	b.Nonce = math.MaxUint64
+	return b.Size()
+}
 
-	if !hash.Gt(lower) || !hash.Lt(upper) {
-		return ErrHashOutOfBounds
+// VerifyLimits checks the block is within the chain's size limits. The
+// transaction count is checked first, as it is cheap.
+func (b *Block) VerifyLimits(params *ChainParams) error {
+	if len(b.Transactions) > params.MaxBlockTransactions {
+		return ErrTooManyTransactions
+	}
+	if b.Size() > params.MaxBlockSize {
+		return ErrBlockTooLarge
 	}
-
 	return nil
 }
 
-func (b *Block) Verify() error {
+func (b *Block) Verify(params *ChainParams) error {
+	if err := b.VerifyLimits(params); err != nil {
+		return err
+	}
 	if err := b.VerifyHash(); err != nil {
 		return err
 	}
@@ -155,9 +181,3 @@ func (b *Block) Verify() error {
 
 	return nil
 }
-
-func (b *Block) Mine() {
-	for b.VerifyHash() != nil {
-		b.Nonce += 1
-	}
-}
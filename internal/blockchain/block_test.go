@@ -3,6 +3,7 @@ package blockchain_test
 import (
 	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"testing"
 
 	"github.com/zakkbob/go-blockchain/internal/blockchain"
@@ -12,7 +13,7 @@ func TestMarshalBlock(t *testing.T) {
 	addr1 := MustGenerateTestAddress(t)
 	addr2 := MustGenerateTestAddress(t)
 
-	tx := addr1.NewTransaction(addr2.PublicKey(), 8)
+	tx := addr1.NewTransaction(addr2.PublicKey(), 8, 0, 0)
 
 	b := blockchain.NewGenesisBlock(10)
 	b.Transactions = append(b.Transactions, tx)
@@ -74,7 +75,7 @@ func TestTransactionBlockMine(t *testing.T) {
 		t.Errorf("GenerateAddress should not return an error: %v", err)
 	}
 
-	tx := sender.NewTransaction(receiver.PublicKey(), 1)
+	tx := sender.NewTransaction(receiver.PublicKey(), 1, 0, 0)
 
 	difficulty := 0
 
@@ -102,3 +103,107 @@ func TestTransactionBlockMine(t *testing.T) {
 		t.Error("Mined block should be valid")
 	}
 }
+
+func TestBlockLimits(t *testing.T) {
+	miner := MustGenerateTestAddress(t)
+
+	l, genesis := MustCreateTestLedger(t)
+	b := NewTestBlock(t, genesis, []blockchain.Transaction{}, 0, miner.PublicKey())
+
+	tests := []struct {
+		name      string
+		change    func(p *blockchain.ChainParams)
+		wantErrIs error
+	}{
+		{
+			name:   "At limits",
+			change: func(p *blockchain.ChainParams) { p.MaxBlockTransactions, p.MaxBlockSize = 1, b.Size() },
+		},
+		{
+			name:      "Too many transactions",
+			change:    func(p *blockchain.ChainParams) { p.MaxBlockTransactions = 0 },
+			wantErrIs: blockchain.ErrTooManyTransactions,
+		},
+		{
+			name:      "Too large",
+			change:    func(p *blockchain.ChainParams) { p.MaxBlockSize = b.Size() - 1 },
+			wantErrIs: blockchain.ErrBlockTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := NewTestParams()
+			tt.change(params)
+
+			if err := b.Verify(params); !errors.Is(err, tt.wantErrIs) {
+				t.Errorf("Verify should return %v, not %v", tt.wantErrIs, err)
+			}
+		})
+	}
+
+	// The ledger enforces its own params
+	l.Params().MaxBlockTransactions = 0
+	if err := l.AddBlock(b); !errors.Is(err, blockchain.ErrTooManyTransactions) {
+		t.Errorf("AddBlock should return %v, not %v", blockchain.ErrTooManyTransactions, err)
+	}
+}
+
+func TestBlockVerifyBody(t *testing.T) {
+	sender := MustGenerateTestAddress(t)
+	receiver := MustGenerateTestAddress(t)
+
+	_, genesis := MustCreateTestLedger(t)
+	tx := sender.NewTransaction(receiver.PublicKey(), 1, 0, 0)
+	b := NewTestBlock(t, genesis, []blockchain.Transaction{tx}, 0, sender.PublicKey())
+	other := NewTestBlock(t, genesis, []blockchain.Transaction{}, 0, receiver.PublicKey())
+
+	if err := b.VerifyBody(&b.BlockHeader); err != nil {
+		t.Errorf("VerifyBody should not return an error: %v", err)
+	}
+
+	if err := other.VerifyBody(&b.BlockHeader); !errors.Is(err, blockchain.ErrHeaderMismatch) {
+		t.Errorf("VerifyBody should return %v, not %v", blockchain.ErrHeaderMismatch, err)
+	}
+
+	// The header is right, but the transactions have been swapped out
+	tampered := b.Clone()
+	tampered.Transactions = tampered.Transactions[:1]
+	if err := tampered.VerifyBody(&b.BlockHeader); !errors.Is(err, blockchain.ErrMerkleRootMismatch) {
+		t.Errorf("VerifyBody should return %v, not %v", blockchain.ErrMerkleRootMismatch, err)
+	}
+}
+
+func TestBlockSpace(t *testing.T) {
+	sender := MustGenerateTestAddress(t)
+	miner := MustGenerateTestAddress(t)
+
+	_, genesis := MustCreateTestLedger(t)
+	txs := []blockchain.Transaction{}
+	for i := range 5 {
+		txs = append(txs, sender.NewTransaction(miner.PublicKey(), 1, uint64(i)*1000, uint64(i)))
+	}
+	b := NewTestBlock(t, genesis, txs, 0, miner.PublicKey())
+
+	// fits counts the transactions into a block limited to maxSize
+	fits := func(maxSize int) bool {
+		params := NewTestParams()
+		params.MaxBlockSize = maxSize
+		space := params.NewBlockSpace(blockchain.CoinbaseBlockSize(genesis.Hash(), 1, 0, miner.PublicKey()))
+		for _, tx := range txs {
+			if !space.Fits(tx.Size()) {
+				return false
+			}
+			space.Add(tx.Size())
+		}
+		return true
+	}
+
+	if !fits(2 * b.Size()) {
+		t.Error("transactions should fit in twice the block's size")
+	}
+	// The counted space may overestimate, but never underestimate
+	if fits(b.Size() - 1) {
+		t.Error("transactions should not fit in less than the block's size")
+	}
+}
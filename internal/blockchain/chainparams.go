@@ -0,0 +1,142 @@
+package blockchain
+
+import (
+	"maps"
+	"time"
+)
+
+// ChainParams are the rules and settings which define a network. Every node
+// on a network must use the same params, or they will disagree about which
+// blocks are valid.
+type ChainParams struct {
+	Name      string
+	NetworkID uint32 // Exchanged when connecting, so nodes on different networks never peer
+
+	InitialReward   uint64        // Paid to the miner of each block, on top of fees
+	HalvingInterval int           // Blocks between each halving of the reward, 0 never halves it
+	BlockInterval   time.Duration // Target time between blocks, in whole seconds
+	RetargetWindow  int           // Blocks between difficulty adjustments, 0 keeps the difficulty fixed
+
+	MaxBlockSize         int // Largest allowed JSON encoded block, in bytes
+	MaxBlockTransactions int
+
+	Genesis GenesisSpec
+}
+
+var networkParams = map[string]ChainParams{
+	"mainnet": {
+		Name:                 "mainnet",
+		NetworkID:            1,
+		InitialReward:        50,
+		HalvingInterval:      210000,
+		BlockInterval:        time.Minute,
+		RetargetWindow:       60,
+		MaxBlockSize:         1 << 20,
+		MaxBlockTransactions: 2000,
+		Genesis: GenesisSpec{
+			Timestamp:  1760000000,
+			Difficulty: 10,
+			Nonce:      707,
+		},
+	},
+	"testnet": {
+		Name:                 "testnet",
+		NetworkID:            2,
+		InitialReward:        50,
+		HalvingInterval:      210000,
+		BlockInterval:        10 * time.Second,
+		RetargetWindow:       20,
+		MaxBlockSize:         1 << 20,
+		MaxBlockTransactions: 2000,
+		Genesis: GenesisSpec{
+			Timestamp:  1760000000,
+			Difficulty: 5,
+			Nonce:      23,
+		},
+	},
+	// Local testing, blocks can be mined instantly
+	"regtest": {
+		Name:                 "regtest",
+		NetworkID:            3,
+		InitialReward:        10,
+		HalvingInterval:      150,
+		BlockInterval:        time.Second,
+		RetargetWindow:       0,
+		MaxBlockSize:         1 << 20,
+		MaxBlockTransactions: 2000,
+		Genesis: GenesisSpec{
+			Timestamp:  1760000000,
+			Difficulty: 0,
+			Nonce:      0,
+		},
+	},
+}
+
+// NetworkParams returns a copy of the built-in params for a network
+func NetworkParams(network string) (*ChainParams, bool) {
+	p, ok := networkParams[network]
+	if !ok {
+		return nil, false
+	}
+	p.Genesis.Alloc = maps.Clone(p.Genesis.Alloc)
+	return &p, true
+}
+
+// BlockSpace adds up the encoded size of a JSON list as entries are added to
+// it, such as the transactions of a block or the blocks of a sync response,
+// so it stays within MaxBlockSize. Each entry counts its own encoded size plus
+// a separating comma, which is never less than the real size.
+type BlockSpace struct {
+	size  int
+	limit int
+}
+
+// NewBlockSpace starts counting from base bytes, the encoded size before any
+// entries are added
+func (p *ChainParams) NewBlockSpace(base int) BlockSpace {
+	return BlockSpace{size: base, limit: p.MaxBlockSize}
+}
+
+// Fits reports whether an entry of encoded size can be added without going
+// over the limit
+func (s *BlockSpace) Fits(size int) bool {
+	return s.size+size+1 <= s.limit
+}
+
+// Add counts an entry of encoded size
+func (s *BlockSpace) Add(size int) {
+	s.size += size + 1
+}
+
+// BlockReward is the amount created by the block at height, which halves
+// every HalvingInterval blocks until it reaches zero. The genesis block, at
+// height 0, has no reward.
+func (p *ChainParams) BlockReward(height int) uint64 {
+	if height <= 0 {
+		return 0
+	}
+	if p.HalvingInterval <= 0 {
+		return p.InitialReward
+	}
+
+	halvings := height / p.HalvingInterval
+	if halvings >= 64 {
+		return 0
+	}
+	return p.InitialReward >> halvings
+}
+
+// MaxSupply is the total amount the reward schedule will ever create, not
+// counting genesis allocations. Without halving, supply is unbounded and
+// MaxSupply returns false.
+func (p *ChainParams) MaxSupply() (uint64, bool) {
+	if p.HalvingInterval <= 0 {
+		return 0, p.InitialReward == 0
+	}
+
+	var supply uint64
+	for reward := p.InitialReward; reward > 0; reward >>= 1 {
+		supply += reward * uint64(p.HalvingInterval)
+	}
+	return supply, true
+}
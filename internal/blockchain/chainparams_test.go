@@ -0,0 +1,132 @@
+package blockchain_test
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/zakkbob/go-blockchain/internal/blockchain"
+)
+
+func TestNetworkParams(t *testing.T) {
+	ids := map[uint32]string{}
+
+	for _, network := range []string{"mainnet", "testnet", "regtest"} {
+		params, ok := blockchain.NetworkParams(network)
+		if !ok {
+			t.Fatalf("%s params should exist", network)
+		}
+
+		if params.Name != network {
+			t.Errorf("expected name %q; got %q", network, params.Name)
+		}
+		if other, ok := ids[params.NetworkID]; ok {
+			t.Errorf("%s and %s share a network ID", network, other)
+		}
+		ids[params.NetworkID] = network
+
+		if _, err := params.Genesis.Block(); err != nil {
+			t.Errorf("%s genesis block should be valid: %v", network, err)
+		}
+	}
+
+	if _, ok := blockchain.NetworkParams("devnet"); ok {
+		t.Error("unknown network should not have params")
+	}
+}
+
+func TestNetworkParamsCopy(t *testing.T) {
+	a, _ := blockchain.NetworkParams("regtest")
+	a.InitialReward = 1000
+
+	b, _ := blockchain.NetworkParams("regtest")
+	if b.InitialReward == 1000 {
+		t.Error("modifying returned params should not change the preset")
+	}
+}
+
+func TestLedgerReward(t *testing.T) {
+	miner := MustGenerateTestAddress(t)
+
+	params := NewTestParams()
+	params.InitialReward = 25
+	l, err := blockchain.NewLedger(params, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	MustAddNewTestBlock(t, l, []blockchain.Transaction{}, miner.PublicKey())
+	AssertAddressBalance(t, l, miner, 25)
+}
+
+func TestBlockReward(t *testing.T) {
+	params := blockchain.ChainParams{InitialReward: 50, HalvingInterval: 10}
+
+	tests := []struct {
+		height int
+		want   uint64
+	}{
+		{height: 0, want: 0},
+		{height: 1, want: 50},
+		{height: 9, want: 50},
+		{height: 10, want: 25},
+		{height: 29, want: 12},
+		{height: 50, want: 1},
+		{height: 60, want: 0},
+		{height: 10 * 70, want: 0},
+	}
+
+	for _, tt := range tests {
+		if got := params.BlockReward(tt.height); got != tt.want {
+			t.Errorf("expected reward of %d at height %d; got %d", tt.want, tt.height, got)
+		}
+	}
+
+	supply, ok := params.MaxSupply()
+	if !ok || supply != (50+25+12+6+3+1)*10 {
+		t.Errorf("expected max supply of 970; got %d (%t)", supply, ok)
+	}
+
+	params.HalvingInterval = 0
+	if got := params.BlockReward(1000); got != 50 {
+		t.Errorf("reward should never halve without a halving interval, got %d", got)
+	}
+	if _, ok := params.MaxSupply(); ok {
+		t.Error("supply should be unbounded without a halving interval")
+	}
+}
+
+func TestLedgerSupply(t *testing.T) {
+	miner := MustGenerateTestAddress(t)
+	receiver := MustGenerateTestAddress(t)
+
+	params := NewTestParams()
+	params.InitialReward = 8
+	params.HalvingInterval = 2
+	params.Genesis.Alloc = map[string]uint64{
+		hex.EncodeToString(receiver.PublicKey()): 100,
+	}
+	if err := params.Genesis.Mine(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := blockchain.NewLedger(params, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Supply() != 100 {
+		t.Errorf("expected genesis supply of 100; got %d", l.Supply())
+	}
+
+	// Heights 1 to 5 pay 8, 4, 4, 2 and 2
+	for range 5 {
+		MustAddNewTestBlock(t, l, []blockchain.Transaction{}, miner.PublicKey())
+	}
+	// Fees aren't new supply
+	MustAddNewTestBlock(t, l, []blockchain.Transaction{receiver.NewTransaction(miner.PublicKey(), 10, 5, 0)}, miner.PublicKey())
+
+	if l.Supply() != 100+8+4+4+2+2+1 {
+		t.Errorf("expected supply of 121; got %d", l.Supply())
+	}
+	AssertAddressBalance(t, l, miner, 8+4+4+2+2+1+10+5)
+	AssertAddressBalance(t, l, receiver, 100-15)
+}
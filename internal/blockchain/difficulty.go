@@ -0,0 +1,37 @@
+package blockchain
+
+import "time"
+
+// Each difficulty step roughly doubles the work needed to mine a block, so a
+// single retarget can change the work by a factor of about 4 at most
+const maxRetargetSteps = 2
+
+// nextDifficulty calculates the difficulty required of a block at height,
+// given the difficulty of its parent and the timestamps of its most recent
+// ancestors (oldest first, the last being the parent)
+func (p *ChainParams) nextDifficulty(height int, difficulty int, timestamps []int64) int {
+	window := p.RetargetWindow
+	if window <= 0 || height%window != 0 || len(timestamps) < window+1 {
+		return difficulty
+	}
+
+	last := len(timestamps) - 1
+	elapsed := timestamps[last] - timestamps[last-window]
+	expected := int64(window) * int64(p.BlockInterval/time.Second)
+
+	return retarget(difficulty, elapsed, expected)
+}
+
+func retarget(difficulty int, elapsed int64, expected int64) int {
+	for i := 0; i < maxRetargetSteps && elapsed*2 <= expected; i++ {
+		difficulty++
+		elapsed *= 2
+	}
+
+	for i := 0; i < maxRetargetSteps && difficulty > 0 && elapsed >= expected*2; i++ {
+		difficulty--
+		elapsed /= 2
+	}
+
+	return difficulty
+}
@@ -0,0 +1,86 @@
+package blockchain
+
+import "slices"
+
+// Event is a change to the best chain, published by a Ledger to its
+// subscribers. It is one of BlockConnected, BlockDisconnected or NewHead.
+type Event interface {
+	event()
+}
+
+// BlockConnected is published when a block becomes part of the best chain
+type BlockConnected struct {
+	Block Block
+}
+
+// BlockDisconnected is published when a block stops being part of the best
+// chain, because a chain with more work has replaced it
+type BlockDisconnected struct {
+	Block Block
+}
+
+// NewHead is published once the best chain has changed, after the blocks
+// which changed have been connected and disconnected
+type NewHead struct {
+	Block        Block    // The new head
+	Length       int      // Length of the new best chain
+	OldHead      [32]byte // Hash of the previous head
+	Disconnected []Block  // Blocks removed from the best chain, newest first
+	Connected    []Block  // Blocks added to the best chain, oldest first
+}
+
+func (BlockConnected) event()    {}
+func (BlockDisconnected) event() {}
+func (NewHead) event()           {}
+
+// Subscribe registers fn to be called with every event, in the order they
+// happen. Events are delivered once the ledger is unlocked, so fn may read
+// from the ledger, but must not add blocks to it. The returned function
+// cancels the subscription.
+func (l *Ledger) Subscribe(fn func(Event)) (unsubscribe func()) {
+	return l.subscribers.Subscribe(fn)
+}
+
+// publish delivers events to every subscriber
+func (l *Ledger) publish(events []Event) {
+	l.subscribers.Publish(events...)
+}
+
+// reorgEvents describes the best chain changing from the chain ending at
+// from to the one ending at to. Both are walked back to the block they share,
+// everything after which has changed.
+func (l *Ledger) reorgEvents(from *Block, fromLength int, to *Block, toLength int) []Event {
+	var (
+		disconnected []Block
+		connected    []Block
+		a, aLength   = from, fromLength
+		b, bLength   = to, toLength
+	)
+
+	for a.Hash() != b.Hash() {
+		if aLength >= bLength {
+			disconnected = append(disconnected, a.Clone())
+			a, aLength = l.blocks[a.PrevBlock], aLength-1
+		} else {
+			connected = append(connected, b.Clone())
+			b, bLength = l.blocks[b.PrevBlock], bLength-1
+		}
+	}
+	slices.Reverse(connected)
+
+	events := make([]Event, 0, len(disconnected)+len(connected)+1)
+	for _, blk := range disconnected {
+		events = append(events, BlockDisconnected{Block: blk})
+	}
+	for _, blk := range connected {
+		events = append(events, BlockConnected{Block: blk})
+	}
+
+	return append(events, NewHead{
+		Block:        to.Clone(),
+		Length:       toLength,
+		OldHead:      from.Hash(),
+		Disconnected: disconnected,
+		Connected:    connected,
+	})
+}
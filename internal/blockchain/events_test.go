@@ -0,0 +1,133 @@
+package blockchain_test
+
+import (
+	"testing"
+
+	"github.com/zakkbob/go-blockchain/internal/blockchain"
+)
+
+// describeEvent is a short description of an event, for comparing sequences
+// of them
+func describeEvent(t *testing.T, e blockchain.Event, names map[[32]byte]string) string {
+	t.Helper()
+	switch e := e.(type) {
+	case blockchain.BlockConnected:
+		return "connected " + names[e.Block.Hash()]
+	case blockchain.BlockDisconnected:
+		return "disconnected " + names[e.Block.Hash()]
+	case blockchain.NewHead:
+		return "head " + names[e.Block.Hash()]
+	default:
+		t.Fatalf("unknown event %T", e)
+		return ""
+	}
+}
+
+func assertEvents(t *testing.T, got []blockchain.Event, expected []string, names map[[32]byte]string) {
+	t.Helper()
+	if len(got) != len(expected) {
+		descriptions := []string{}
+		for _, e := range got {
+			descriptions = append(descriptions, describeEvent(t, e, names))
+		}
+		t.Fatalf("expected events %v; got %v", expected, descriptions)
+	}
+	for i, e := range got {
+		if d := describeEvent(t, e, names); d != expected[i] {
+			t.Errorf("event %d should be %q, not %q", i, expected[i], d)
+		}
+	}
+}
+
+func TestLedgerEvents(t *testing.T) {
+	minerA := MustGenerateTestAddress(t)
+	minerB := MustGenerateTestAddress(t)
+
+	l, genesis := MustCreateTestLedger(t)
+
+	block1 := NewTestBlock(t, genesis, []blockchain.Transaction{}, 0, minerA.PublicKey())
+	blockA2 := NewTestBlock(t, &block1, []blockchain.Transaction{}, 0, minerA.PublicKey())
+	blockB2 := NewTestBlock(t, &block1, []blockchain.Transaction{}, 0, minerB.PublicKey())
+	blockB3 := NewTestBlock(t, &blockB2, []blockchain.Transaction{}, 0, minerB.PublicKey())
+	blockA3 := NewTestBlock(t, &blockA2, []blockchain.Transaction{}, 0, minerA.PublicKey())
+	blockA4 := NewTestBlock(t, &blockA3, []blockchain.Transaction{}, 0, minerA.PublicKey())
+
+	names := map[[32]byte]string{
+		block1.Hash():  "1",
+		blockA2.Hash(): "A2",
+		blockB2.Hash(): "B2",
+		blockB3.Hash(): "B3",
+		blockA3.Hash(): "A3",
+		blockA4.Hash(): "A4",
+	}
+
+	var events []blockchain.Event
+	l.Subscribe(func(e blockchain.Event) {
+		// The ledger can be read while events are delivered
+		if h, ok := e.(blockchain.NewHead); ok && l.HeadHash() != h.Block.Hash() {
+			t.Error("ledger head should be the new head")
+		}
+		events = append(events, e)
+	})
+
+	MustAddTestBlock(t, l, block1)
+	assertEvents(t, events, []string{"connected 1", "head 1"}, names)
+
+	// Whichever of A2 and B2 has the lowest hash becomes the head, so make sure
+	// A is on top to begin with
+	events = nil
+	MustAddTestBlock(t, l, blockA2)
+	MustAddTestBlock(t, l, blockA3)
+	assertEvents(t, events, []string{"connected A2", "head A2", "connected A3", "head A3"}, names)
+
+	// A side chain with less work changes nothing
+	events = nil
+	MustAddTestBlock(t, l, blockB2)
+	assertEvents(t, events, []string{}, names)
+
+	// Equal work may or may not reorg, depending on the hashes
+	events = nil
+	MustAddTestBlock(t, l, blockB3)
+	if l.HeadHash() == blockB3.Hash() {
+		assertEvents(t, events, []string{"disconnected A3", "disconnected A2", "connected B2", "connected B3", "head B3"}, names)
+
+		head := events[len(events)-1].(blockchain.NewHead)
+		if head.OldHead != blockA3.Hash() || head.Length != 4 || len(head.Disconnected) != 2 || len(head.Connected) != 2 {
+			t.Errorf("new head should describe the reorg, got %+v", head)
+		}
+		if head.Connected[0].Hash() != blockB2.Hash() || head.Disconnected[0].Hash() != blockA3.Hash() {
+			t.Error("connected blocks should be oldest first, and disconnected blocks newest first")
+		}
+
+		events = nil
+		MustAddTestBlock(t, l, blockA4)
+		assertEvents(t, events, []string{"disconnected B3", "disconnected B2", "connected A2", "connected A3", "connected A4", "head A4"}, names)
+	} else {
+		assertEvents(t, events, []string{}, names)
+
+		events = nil
+		MustAddTestBlock(t, l, blockA4)
+		assertEvents(t, events, []string{"connected A4", "head A4"}, names)
+	}
+}
+
+func TestLedgerUnsubscribe(t *testing.T) {
+	miner := MustGenerateTestAddress(t)
+
+	l, _ := MustCreateTestLedger(t)
+
+	var a, b int
+	unsubscribe := l.Subscribe(func(blockchain.Event) { a++ })
+	l.Subscribe(func(blockchain.Event) { b++ })
+
+	MustAddNewTestBlock(t, l, []blockchain.Transaction{}, miner.PublicKey())
+	unsubscribe()
+	MustAddNewTestBlock(t, l, []blockchain.Transaction{}, miner.PublicKey())
+
+	if a != 2 {
+		t.Errorf("expected 2 events before unsubscribing; got %d", a)
+	}
+	if b != 4 {
+		t.Errorf("expected 4 events; got %d", b)
+	}
+}
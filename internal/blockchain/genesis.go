@@ -0,0 +1,111 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+)
+
+var (
+	ErrGenesisMismatch = errors.New("genesis block does not match the genesis specification")
+)
+
+// GenesisSpec describes a chain's genesis block. Every node on a network must
+// use the same spec, or they will never agree on a chain.
+type GenesisSpec struct {
+	Timestamp  int64             `json:"timestamp"`
+	Difficulty int               `json:"difficulty"`
+	Nonce      uint64            `json:"nonce"`
+	Alloc      map[string]uint64 `json:"alloc,omitempty"` // Initial balances, keyed by hex encoded public key
+}
+
+// LoadGenesisSpec reads a JSON encoded genesis spec from a file
+func LoadGenesisSpec(path string) (GenesisSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return GenesisSpec{}, fmt.Errorf("reading genesis spec: %w", err)
+	}
+
+	var g GenesisSpec
+	if err := json.Unmarshal(data, &g); err != nil {
+		return GenesisSpec{}, fmt.Errorf("decoding genesis spec: %w", err)
+	}
+
+	return g, nil
+}
+
+// allocations returns the initial balances as sender-less transactions,
+// ordered by receiver so every node builds the same genesis block
+func (g *GenesisSpec) allocations() ([]Transaction, error) {
+	txs := make([]Transaction, 0, len(g.Alloc))
+	var total uint64
+
+	for key, value := range g.Alloc {
+		pubkey, err := hex.DecodeString(key)
+		if err != nil || len(pubkey) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid genesis allocation public key %q", key)
+		}
+
+		if total+value < total {
+			return nil, errors.New("genesis allocations overflow")
+		}
+		total += value
+
+		txs = append(txs, Transaction{
+			Receiver: pubkey,
+			Value:    value,
+		})
+	}
+
+	slices.SortFunc(txs, func(a, b Transaction) int {
+		return bytes.Compare(a.Receiver, b.Receiver)
+	})
+
+	return txs, nil
+}
+
+func (g *GenesisSpec) unminedBlock() (Block, error) {
+	txs, err := g.allocations()
+	if err != nil {
+		return Block{}, err
+	}
+
+	b := NewGenesisBlock(g.Difficulty)
+	b.Timestamp = g.Timestamp
+	b.Nonce = g.Nonce
+	b.Transactions = txs
+	b.MerkleRoot = MerkleRoot(txs)
+
+	return b, nil
+}
+
+// Block builds the genesis block, checking the spec's nonce is valid
+func (g *GenesisSpec) Block() (Block, error) {
+	b, err := g.unminedBlock()
+	if err != nil {
+		return Block{}, err
+	}
+
+	if err := b.VerifyHash(); err != nil {
+		return Block{}, fmt.Errorf("genesis nonce does not satisfy its difficulty: %w", err)
+	}
+
+	return b, nil
+}
+
+// Mine finds a valid nonce for the spec, for use when creating a new network
+func (g *GenesisSpec) Mine() error {
+	b, err := g.unminedBlock()
+	if err != nil {
+		return err
+	}
+
+	b.Mine()
+	g.Nonce = b.Nonce
+	return nil
+}
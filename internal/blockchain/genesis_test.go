@@ -0,0 +1,94 @@
+package blockchain_test
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zakkbob/go-blockchain/internal/blockchain"
+)
+
+func TestGenesisDeterministic(t *testing.T) {
+	l1, _ := MustCreateTestLedger(t)
+	l2, _ := MustCreateTestLedger(t)
+
+	if l1.GenesisHash() != l2.GenesisHash() || l1.HeadHash() != l1.GenesisHash() {
+		t.Error("ledgers created from the same spec should share a genesis block")
+	}
+}
+
+func TestGenesisAlloc(t *testing.T) {
+	addr1 := MustGenerateTestAddress(t)
+	addr2 := MustGenerateTestAddress(t)
+
+	params := NewTestParams()
+	spec := params.Genesis
+	spec.Alloc = map[string]uint64{
+		hex.EncodeToString(addr1.PublicKey()): 100,
+		hex.EncodeToString(addr2.PublicKey()): 50,
+	}
+	if err := spec.Mine(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "genesis.json")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := blockchain.LoadGenesisSpec(path)
+	if err != nil {
+		t.Fatalf("LoadGenesisSpec should not return an error: %v", err)
+	}
+
+	params.Genesis = loaded
+	l, err := blockchain.NewLedger(params, nil)
+	if err != nil {
+		t.Fatalf("NewLedger should not return an error: %v", err)
+	}
+
+	expected, _ := spec.Block()
+	if l.GenesisHash() != expected.Hash() {
+		t.Error("loaded spec should produce the same genesis block")
+	}
+
+	AssertAddressBalance(t, l, addr1, 100)
+	AssertAddressBalance(t, l, addr2, 50)
+
+	MustAddNewTestBlock(t, l, []blockchain.Transaction{addr1.NewTransaction(addr2.PublicKey(), 30, 0, 0)}, addr1.PublicKey())
+	AssertAddressBalance(t, l, addr1, 80)
+	AssertAddressBalance(t, l, addr2, 80)
+}
+
+func TestGenesisInvalidNonce(t *testing.T) {
+	params, _ := blockchain.NetworkParams("mainnet")
+	spec := params.Genesis
+	spec.Nonce++
+
+	if _, err := spec.Block(); !errors.Is(err, blockchain.ErrHashOutOfBounds) {
+		t.Errorf("Block should return %v, not %v", blockchain.ErrHashOutOfBounds, err)
+	}
+}
+
+func TestGenesisAllocOverflow(t *testing.T) {
+	addr1 := MustGenerateTestAddress(t)
+	addr2 := MustGenerateTestAddress(t)
+
+	spec := NewTestParams().Genesis
+	spec.Alloc = map[string]uint64{
+		hex.EncodeToString(addr1.PublicKey()): math.MaxUint64,
+		hex.EncodeToString(addr2.PublicKey()): 1,
+	}
+
+	if _, err := spec.Block(); err == nil {
+		t.Error("Block should reject allocations which overflow")
+	}
+}
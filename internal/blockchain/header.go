@@ -0,0 +1,150 @@
+package blockchain
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/holiman/uint256"
+)
+
+// BlockVersion is the protocol version of blocks created by this node. Rule
+// changes bump it, so blocks following the new rules can be told apart.
+const BlockVersion uint32 = 1
+
+var ErrHeaderNotLinked = errors.New("header does not follow the previous header")
+
+var pi, _ = uint256.FromDecimal("31415926535897932384626433832795028841971693993751058209749445923078164062862")
+
+// BlockHeader holds everything the proof-of-work commits to. The transactions
+// themselves are only committed to through MerkleRoot, so a header can be
+// verified without the block body.
+type BlockHeader struct {
+	Version    uint32            `json:"version"`
+	Difficulty int               `json:"difficulty"`
+	PrevBlock  [32]byte          `json:"previous_block"`
+	Nonce      uint64            `json:"nonce"`
+	MerkleRoot [32]byte          `json:"merkle_root"` // Root of the Merkle tree over the block's transactions
+	Timestamp  int64             `json:"timestamp"`
+	Miner      ed25519.PublicKey `json:"miner"`
+	Genesis    bool              `json:"genesis"`
+}
+
+func (h *BlockHeader) Clone() BlockHeader {
+	c := *h
+	c.Miner = slices.Clone(h.Miner)
+	return c
+}
+
+// Bytes returns the canonical serialization of the header, which is what
+// gets hashed. The nonce is always the final 8 bytes, so miners can reuse the
+// rest between attempts.
+func (h *BlockHeader) Bytes() []byte {
+	data := make([]byte, 0, 4+32+32+8+1+2+len(h.Miner)+8+8)
+	data = binary.LittleEndian.AppendUint32(data, h.Version)
+	data = append(data, h.PrevBlock[:]...)
+	data = append(data, h.MerkleRoot[:]...)
+	data = binary.LittleEndian.AppendUint64(data, uint64(h.Difficulty))
+	if h.Genesis {
+		data = append(data, 1)
+	} else {
+		data = append(data, 0)
+	}
+	data = binary.LittleEndian.AppendUint16(data, uint16(len(h.Miner)))
+	data = append(data, h.Miner...)
+	data = binary.LittleEndian.AppendUint64(data, uint64(h.Timestamp))
+	data = binary.LittleEndian.AppendUint64(data, h.Nonce)
+	return data
+}
+
+// Size is the length of the header's JSON encoding
+func (h *BlockHeader) Size() int {
+	return encodedSize(h)
+}
+
+func (h *BlockHeader) Hash() [32]byte {
+	return sha256.Sum256(h.Bytes())
+}
+
+func (h *BlockHeader) uint256Hash() *uint256.Int {
+	hash := h.Hash()
+	uint256Hash := uint256.NewInt(0)
+	uint256Hash.SetBytes(hash[:])
+	return uint256Hash
+}
+
+// Target returns the exclusive bounds a block hash must fall between to
+// satisfy difficulty
+func Target(difficulty int) (lower *uint256.Int, upper *uint256.Int) {
+	digits := 77 - difficulty/3
+	divisor := math.Pow(2, float64(difficulty%3))
+
+	lower = pi.Clone()
+	div := uint256.NewInt(10)
+	exp := uint256.NewInt(uint64(digits))
+
+	div.Exp(div, exp)
+	lower.Div(lower, div)
+	lower.Mul(lower, div)
+
+	div.Div(div, uint256.NewInt(uint64(divisor)))
+
+	upper = lower.Clone()
+	upper.Add(upper, div)
+
+	return lower, upper
+}
+
+// Work is the expected number of hashes needed to mine a block at the header's
+// difficulty, i.e. the size of the hash space divided by the target window
+func (h *BlockHeader) Work() *uint256.Int {
+	lower, upper := Target(h.Difficulty)
+
+	window := new(uint256.Int).Sub(upper, lower)
+	window.SubUint64(window, 1) // both bounds are exclusive
+
+	work := new(uint256.Int).SetAllOne()
+	return work.Div(work, window)
+}
+
+func (h *BlockHeader) VerifyHash() error {
+	hash := h.uint256Hash()
+	lower, upper := Target(h.Difficulty)
+
+	if !hash.Gt(lower) || !hash.Lt(upper) {
+		return ErrHashOutOfBounds
+	}
+
+	return nil
+}
+
+func (h *BlockHeader) Mine() {
+	for h.VerifyHash() != nil {
+		h.Nonce += 1
+	}
+}
+
+// VerifyHeaderChain checks headers form a chain following the block with hash
+// prev, and each has valid proof-of-work. Rules which depend on the state of
+// the chain, such as the required difficulty, are left to the Ledger when
+// the full blocks are added.
+func VerifyHeaderChain(prev [32]byte, headers []BlockHeader) error {
+	for i := range headers {
+		h := &headers[i]
+
+		if h.Genesis || h.PrevBlock != prev {
+			return fmt.Errorf("header %d: %w", i, ErrHeaderNotLinked)
+		}
+		if err := h.VerifyHash(); err != nil {
+			return fmt.Errorf("header %d: %w", i, err)
+		}
+
+		prev = h.Hash()
+	}
+
+	return nil
+}
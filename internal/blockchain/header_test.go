@@ -0,0 +1,122 @@
+package blockchain_test
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/zakkbob/go-blockchain/internal/blockchain"
+)
+
+func TestBlockHeaderHash(t *testing.T) {
+	sender := MustGenerateTestAddress(t)
+	receiver := MustGenerateTestAddress(t)
+
+	tx := sender.NewTransaction(receiver.PublicKey(), 1, 0, 0)
+	b := blockchain.NewBlock([32]byte{1}, []blockchain.Transaction{tx}, 0, receiver.PublicKey())
+	b.Mine()
+
+	if b.Hash() != b.BlockHeader.Hash() {
+		t.Error("block hash should be the header hash")
+	}
+
+	data := b.BlockHeader.Bytes()
+	if binary.LittleEndian.Uint64(data[len(data)-8:]) != b.Nonce {
+		t.Error("serialized header should end with the nonce")
+	}
+
+	changes := map[string]func(h *blockchain.BlockHeader){
+		"version":     func(h *blockchain.BlockHeader) { h.Version++ },
+		"difficulty":  func(h *blockchain.BlockHeader) { h.Difficulty++ },
+		"prev block":  func(h *blockchain.BlockHeader) { h.PrevBlock[0]++ },
+		"merkle root": func(h *blockchain.BlockHeader) { h.MerkleRoot[0]++ },
+		"timestamp":   func(h *blockchain.BlockHeader) { h.Timestamp++ },
+		"miner":       func(h *blockchain.BlockHeader) { h.Miner = sender.PublicKey() },
+		"genesis":     func(h *blockchain.BlockHeader) { h.Genesis = !h.Genesis },
+		"nonce":       func(h *blockchain.BlockHeader) { h.Nonce++ },
+	}
+
+	for field, change := range changes {
+		header := b.BlockHeader.Clone()
+		change(&header)
+		if header.Hash() == b.Hash() {
+			t.Errorf("changing the %s should change the hash", field)
+		}
+	}
+
+	header := b.BlockHeader.Clone()
+	header.Difficulty++
+	header.Mine()
+	if err := header.VerifyHash(); err != nil {
+		t.Errorf("mined header should be valid: %v", err)
+	}
+}
+
+func TestMarshalBlockHeader(t *testing.T) {
+	miner := MustGenerateTestAddress(t)
+
+	b := blockchain.NewBlock([32]byte{1}, []blockchain.Transaction{}, 0, miner.PublicKey())
+	b.Mine()
+
+	js, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var header blockchain.BlockHeader
+	if err := json.Unmarshal(js, &header); err != nil {
+		t.Fatal(err)
+	}
+
+	if header.Hash() != b.Hash() {
+		t.Error("header decoded from a block should have the block's hash")
+	}
+}
+
+func TestVerifyHeaderChain(t *testing.T) {
+	miner := MustGenerateTestAddress(t)
+
+	_, genesis := MustCreateTestLedger(t)
+
+	block1 := NewTestBlock(t, genesis, []blockchain.Transaction{}, 0, miner.PublicKey())
+	block2 := NewTestBlock(t, &block1, []blockchain.Transaction{}, 0, miner.PublicKey())
+	block3 := NewTestBlock(t, &block2, []blockchain.Transaction{}, 0, miner.PublicKey())
+
+	headers := func() []blockchain.BlockHeader {
+		return []blockchain.BlockHeader{block1.BlockHeader.Clone(), block2.BlockHeader.Clone(), block3.BlockHeader.Clone()}
+	}
+
+	if err := blockchain.VerifyHeaderChain(genesis.Hash(), headers()); err != nil {
+		t.Errorf("VerifyHeaderChain should not return an error: %v", err)
+	}
+	if err := blockchain.VerifyHeaderChain(genesis.Hash(), nil); err != nil {
+		t.Errorf("VerifyHeaderChain should not return an error for no headers: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		prev     [32]byte
+		change   func(h []blockchain.BlockHeader) []blockchain.BlockHeader
+		expected error
+	}{
+		{"wrong start", block1.Hash(), func(h []blockchain.BlockHeader) []blockchain.BlockHeader { return h }, blockchain.ErrHeaderNotLinked},
+		{"gap", genesis.Hash(), func(h []blockchain.BlockHeader) []blockchain.BlockHeader { return []blockchain.BlockHeader{h[0], h[2]} }, blockchain.ErrHeaderNotLinked},
+		{"genesis", genesis.Hash(), func(h []blockchain.BlockHeader) []blockchain.BlockHeader {
+			return append([]blockchain.BlockHeader{genesis.BlockHeader.Clone()}, h...)
+		}, blockchain.ErrHeaderNotLinked},
+		{"invalid proof-of-work", genesis.Hash(), func(h []blockchain.BlockHeader) []blockchain.BlockHeader {
+			h[2].Difficulty = 30
+			return h
+		}, blockchain.ErrHashOutOfBounds},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := blockchain.VerifyHeaderChain(tt.prev, tt.change(headers()))
+			if !errors.Is(err, tt.expected) {
+				t.Errorf("VerifyHeaderChain should return %v, not %v", tt.expected, err)
+			}
+		})
+	}
+}
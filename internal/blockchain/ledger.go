@@ -1,20 +1,36 @@
 package blockchain
 
 import (
+	"bytes"
 	"crypto/ed25519"
 	"crypto/sha256"
 	"errors"
 	"fmt"
 	"maps"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/holiman/uint256"
+	"github.com/zakkbob/go-blockchain/internal/pubsub"
 )
 
-const MINER_REWARD = 10 // absolutely arbitrary
+const (
+	MaxFutureBlockTime = 2 * time.Hour // How far ahead of the local clock a block may be dated
+	MedianTimeSpan     = 11            // Number of previous blocks a timestamp must be newer than the median of
+)
 
 var (
-	ErrInsufficientBalance = errors.New("insufficient balance for transaction")
+	ErrInsufficientBalance  = errors.New("insufficient balance for transaction")
+	ErrInvalidNonce         = errors.New("transaction nonce is not the sender's next nonce")
+	ErrUnexpectedDifficulty = errors.New("block difficulty does not match the difficulty required by the chain")
+	ErrTimestampTooNew      = errors.New("block timestamp is too far in the future")
+	ErrTimestampTooOld      = errors.New("block timestamp is not after the median time of previous blocks")
+	ErrUnsupportedVersion   = errors.New("block version is not supported")
+	ErrUnexpectedGenesis    = errors.New("genesis block cannot extend a chain")
+	ErrKnownBlock           = errors.New("block is already in the ledger")
+	ErrCoinbaseHeight       = errors.New("coinbase nonce is not the block height")
+	ErrCoinbaseTooLarge     = errors.New("coinbase claims more than the block reward plus fees")
 )
 
 type ErrPrevBlockNotFound struct {
@@ -27,40 +43,119 @@ func (e ErrPrevBlockNotFound) Error() string {
 	return fmt.Sprintf("previous block with hash %s could not be found", uint256Hash.Dec())
 }
 
+type account struct {
+	balance uint64
+	nonce   uint64 // next expected transaction nonce
+}
+
 type Balances struct {
-	balances map[[32]byte]uint64 // indexed by public key hash
+	accounts map[[32]byte]account // indexed by public key hash
+}
+
+func NewBalances() Balances {
+	return Balances{
+		accounts: map[[32]byte]account{},
+	}
 }
 
 func (b *Balances) Clone() Balances {
 	return Balances{
-		balances: maps.Clone(b.balances),
+		accounts: maps.Clone(b.accounts),
 	}
 }
 
 func (b *Balances) Get(pubkey ed25519.PublicKey) uint64 {
 	hash := sha256.Sum256(pubkey)
-	return b.balances[hash]
+	return b.accounts[hash].balance
 }
 
 func (b *Balances) Set(pubkey ed25519.PublicKey, bal uint64) {
 	hash := sha256.Sum256(pubkey)
-	b.balances[hash] = bal
+	a := b.accounts[hash]
+	a.balance = bal
+	b.accounts[hash] = a
 }
 
 func (b *Balances) Increase(pubkey ed25519.PublicKey, n uint64) {
 	hash := sha256.Sum256(pubkey)
-	b.balances[hash] += n
+	a := b.accounts[hash]
+	a.balance += n
+	b.accounts[hash] = a
 }
 
 func (b *Balances) Decrease(pubkey ed25519.PublicKey, n uint64) {
 	hash := sha256.Sum256(pubkey)
-	b.balances[hash] -= n
+	a := b.accounts[hash]
+	a.balance -= n
+	b.accounts[hash] = a
+}
+
+// Nonce returns the nonce the next transaction sent by pubkey must carry
+func (b *Balances) Nonce(pubkey ed25519.PublicKey) uint64 {
+	hash := sha256.Sum256(pubkey)
+	return b.accounts[hash].nonce
+}
+
+func (b *Balances) IncrementNonce(pubkey ed25519.PublicKey) {
+	hash := sha256.Sum256(pubkey)
+	a := b.accounts[hash]
+	a.nonce++
+	b.accounts[hash] = a
 }
 
 type head struct {
-	block    *Block
-	length   int
-	balances Balances
+	block      *Block
+	length     int
+	work       *uint256.Int // total work of every block in the chain
+	balances   Balances
+	supply     uint64 // total amount in circulation
+	params     *ChainParams
+	timestamps []int64 // timestamps of the most recent blocks, oldest first
+}
+
+func newHead(genesis *Block, params *ChainParams) *head {
+	balances := NewBalances()
+	var supply uint64
+	for _, alloc := range genesis.Transactions {
+		balances.Increase(alloc.Receiver, alloc.Value)
+		supply += alloc.Value
+	}
+
+	return &head{
+		block:      genesis,
+		length:     1,
+		work:       genesis.Work(),
+		balances:   balances,
+		supply:     supply,
+		params:     params,
+		timestamps: []int64{genesis.Timestamp},
+	}
+}
+
+// nextDifficulty is the difficulty required of the next block on this head
+func (h *head) nextDifficulty() int {
+	return h.params.nextDifficulty(h.length, h.block.Difficulty, h.timestamps)
+}
+
+// medianTime is the median timestamp of the last MedianTimeSpan blocks, the
+// next block on this head must be dated after it
+func (h *head) medianTime() int64 {
+	recent := h.timestamps[max(0, len(h.timestamps)-MedianTimeSpan):]
+	sorted := slices.Sorted(slices.Values(recent))
+	return sorted[len(sorted)/2]
+}
+
+// betterThan reports whether h should be preferred over o as the best head.
+// The chain with the most total work wins, ties go to the lowest block hash
+// so every node picks the same head regardless of the order blocks arrive in.
+func (h *head) betterThan(o *head) bool {
+	if c := h.work.Cmp(o.work); c != 0 {
+		return c > 0
+	}
+
+	hHash := h.block.Hash()
+	oHash := o.block.Hash()
+	return bytes.Compare(hHash[:], oHash[:]) < 0
 }
 
 func (h *head) Update(b *Block) error {
@@ -68,66 +163,216 @@ func (h *head) Update(b *Block) error {
 		panic("what in the heck")
 	}
 
+	if b.Version != BlockVersion {
+		return ErrUnsupportedVersion
+	}
+	if b.Genesis {
+		return ErrUnexpectedGenesis
+	}
+	if b.Difficulty != h.nextDifficulty() {
+		return ErrUnexpectedDifficulty
+	}
+	if b.Timestamp <= h.medianTime() {
+		return ErrTimestampTooOld
+	}
+
+	if len(b.Transactions) == 0 {
+		return ErrMissingCoinbase
+	}
+
+	// The block at height h.length, its coinbase commits to the height so no
+	// two coinbases share a hash
+	height := h.length
+	coinbase := b.Transactions[0]
+	if coinbase.Nonce != uint64(height) {
+		return ErrCoinbaseHeight
+	}
+
 	balances := h.balances.Clone()
+	var fees uint64
 
-	for _, tx := range b.Transactions {
+	for _, tx := range b.Transactions[1:] {
 		if err := tx.Verify(); err != nil {
 			return err
 		}
 
-		if balances.Get(tx.Sender) < tx.Value {
+		// Nonces must increase by exactly one per transaction, so a signed
+		// transaction can never be included twice
+		if tx.Nonce != balances.Nonce(tx.Sender) {
+			return ErrInvalidNonce
+		}
+
+		if balances.Get(tx.Sender) < tx.Cost() {
 			return ErrInsufficientBalance
 		}
 
-		balances.Decrease(tx.Sender, tx.Value)
+		balances.Decrease(tx.Sender, tx.Cost())
 		balances.Increase(tx.Receiver, tx.Value)
+		balances.IncrementNonce(tx.Sender)
+		fees += tx.Fee
 	}
 
-	balances.Increase(b.Miner, MINER_REWARD)
+	// Claiming less than allowed is fine, the rest is never created
+	claimed, ok := coinbase.CoinbaseValue()
+	if !ok || claimed > h.params.BlockReward(height)+fees {
+		return ErrCoinbaseTooLarge
+	}
+	balances.Increase(coinbase.Receiver, coinbase.Value)
+	for _, o := range coinbase.Outputs {
+		balances.Increase(o.Receiver, o.Value)
+	}
 
 	h.balances = balances
+	h.supply = h.supply - fees + claimed
 	h.block = b
 	h.length++
+	h.work = new(uint256.Int).Add(h.work, b.Work())
+
+	// Only the ancestors needed for retargeting and the median time are kept
+	h.timestamps = append(h.timestamps, b.Timestamp)
+	if extra := len(h.timestamps) - max(h.params.RetargetWindow+1, MedianTimeSpan); extra > 0 {
+		h.timestamps = slices.Clone(h.timestamps[extra:])
+	}
 
 	return nil
 }
 
 type Ledger struct {
-	blocks map[[32]byte]*Block // All known, verified blocks
-	heads  []*head             // All possible heads of chains from the known blocks
-	head   *head               // The longest head (chain with most work)
+	genesis [32]byte
+	blocks  map[[32]byte]*Block // All known, verified blocks
+	heads   []*head             // All possible heads of chains from the known blocks
+	head    *head               // The best head (chain with most work)
+
+	params *ChainParams
+	now    func() time.Time // Local clock, used to reject blocks from the future
+	store  Store            // Where accepted blocks are persisted, may be nil
+
+	subscribers pubsub.Subscribers[Event]
+	publishMu   sync.Mutex // Held while a block is added and its events delivered, so they arrive in order
 
 	mu sync.RWMutex
 }
 
-func NewLedger(difficulty int) (*Ledger, error) {
-	genesis := NewGenesisBlock(difficulty)
-	genesis.Mine()
+// NewLedger creates a ledger for the chain defined by params, backed by
+// store. If the store already holds the chain it is reloaded and
+// every block revalidated, otherwise the genesis block is saved. A nil store
+// keeps the chain in memory only.
+func NewLedger(params *ChainParams, store Store) (*Ledger, error) {
+	genesis, err := params.Genesis.Block()
+	if err != nil {
+		return nil, err
+	}
 
-	balances := Balances{
-		balances: map[[32]byte]uint64{},
+	var stored []Block
+	if store != nil {
+		stored, err = store.Blocks()
+		if err != nil {
+			return nil, fmt.Errorf("loading stored blocks: %w", err)
+		}
 	}
 
-	h := &head{
-		block:    &genesis,
-		length:   1,
-		balances: balances,
+	if len(stored) > 0 {
+		if stored[0].Hash() != genesis.Hash() {
+			return nil, fmt.Errorf("first stored block: %w", ErrGenesisMismatch)
+		}
+	} else if store != nil {
+		if err := store.Put(&genesis); err != nil {
+			return nil, fmt.Errorf("storing genesis block: %w", err)
+		}
 	}
 
+	h := newHead(&genesis, params)
+
 	blocks := map[[32]byte]*Block{}
 	blocks[genesis.Hash()] = &genesis
 
 	c := Ledger{
-		blocks: blocks,
-		heads:  []*head{h},
-		head:   h,
+		genesis: genesis.Hash(),
+		blocks:  blocks,
+		heads:   []*head{h},
+		head:    h,
+		params:  params,
+		now:     time.Now,
+	}
+
+	// Stored blocks are replayed before the store is attached, so they aren't
+	// saved a second time
+	for _, b := range stored[min(1, len(stored)):] {
+		if err := c.AddBlock(b); err != nil {
+			return nil, fmt.Errorf("revalidating stored block %x: %w", b.Hash(), err)
+		}
 	}
+	c.store = store
 
 	return &c, nil
 }
 
+// CalculateFutureDifficulty returns the difficulty required of the next block
+// on the best chain
 func (l *Ledger) CalculateFutureDifficulty() int {
-	return l.head.block.Difficulty
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.head.nextDifficulty()
+}
+
+// MinOrphanDifficulty returns the lowest difficulty a block whose parent isn't
+// known yet could plausibly have. It may be on a fork which has retargeted
+// since splitting from the best chain, so one retarget below the next
+// difficulty is allowed, but anything easier is cheap to forge.
+func (l *Ledger) MinOrphanDifficulty() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return max(0, l.head.nextDifficulty()-maxRetargetSteps)
+}
+
+// SetClock replaces the clock used to validate block timestamps
+func (l *Ledger) SetClock(now func() time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.now = now
+}
+
+// MedianTimePast returns the time the next block on the best chain must be
+// dated after
+func (l *Ledger) MedianTimePast() int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.head.medianTime()
+}
+
+// BlockTemplate is the state of the best chain which the next block on it is
+// built from
+type BlockTemplate struct {
+	PrevBlock      [32]byte
+	Height         int
+	Difficulty     int
+	MedianTimePast int64    // The block must be dated after this
+	Balances       Balances // A copy, which may be changed freely
+}
+
+// NextBlockTemplate returns everything needed to build the next block on the
+// best chain. It is all read at once, as reading each part separately could
+// mix up two heads if a block is added in between.
+func (l *Ledger) NextBlockTemplate() BlockTemplate {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return BlockTemplate{
+		PrevBlock:      l.head.block.Hash(),
+		Height:         l.head.length,
+		Difficulty:     l.head.nextDifficulty(),
+		MedianTimePast: l.head.medianTime(),
+		Balances:       l.head.balances.Clone(),
+	}
+}
+
+// Params returns the rules of the ledger's chain
+func (l *Ledger) Params() *ChainParams {
+	return l.params
+}
+
+// GenesisHash returns the hash of the first block of the chain
+func (l *Ledger) GenesisHash() [32]byte {
+	return l.genesis
 }
 
 func (l *Ledger) HeadHash() [32]byte {
@@ -140,6 +385,55 @@ func (l *Ledger) Balances() Balances {
 	return l.head.balances.Clone()
 }
 
+// Supply returns the total amount in circulation on the best chain, including
+// genesis allocations
+func (l *Ledger) Supply() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.head.supply
+}
+
+// Work returns the total work of the best chain
+func (l *Ledger) Work() *uint256.Int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.head.work.Clone()
+}
+
+// WorkAt returns the total work of the chain ending at a known block
+func (l *Ledger) WorkAt(hash [32]byte) (*uint256.Int, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if _, ok := l.blocks[hash]; !ok {
+		return nil, false
+	}
+	if h, ok := l.getHead(hash); ok {
+		return h.work.Clone(), true
+	}
+
+	work := uint256.NewInt(0)
+	for _, b := range l.getChain(hash) {
+		work.Add(work, b.Work())
+	}
+	return work, true
+}
+
+// LengthAt returns the length of the chain ending at the block with hash, if
+// it is known
+func (l *Ledger) LengthAt(hash [32]byte) (int, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if _, ok := l.blocks[hash]; !ok {
+		return 0, false
+	}
+	if h, ok := l.getHead(hash); ok {
+		return h.length, true
+	}
+	return len(l.getChain(hash)), true
+}
+
 func (l *Ledger) Length() int {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
@@ -179,33 +473,50 @@ func (l *Ledger) headFromBlock(hash [32]byte) *head {
 	c := l.getChain(hash)
 	genesis := c[len(c)-1]
 
-	h := head{
-		block:  genesis,
-		length: 1,
-		balances: Balances{
-			balances: map[[32]byte]uint64{},
-		},
-	}
+	h := newHead(genesis, l.params)
 
 	for i := len(c) - 2; i >= 0; i-- {
 		h.Update(c[i])
 	}
 
-	return &h
+	return h
 }
 
+// AddBlock validates a block and adds it to the ledger. If it changes the best
+// chain, subscribers are told before AddBlock returns.
 func (l *Ledger) AddBlock(b Block) error {
 	b = b.Clone()
 
-	if err := b.Verify(); err != nil {
+	if err := b.Verify(l.params); err != nil {
 		return err
 	}
 
+	// Blocks are added one at a time anyway, this also keeps their events in
+	// order
+	l.publishMu.Lock()
+	defer l.publishMu.Unlock()
+
+	events, err := l.addBlock(b)
+	l.publish(events)
+	return err
+}
+
+// addBlock adds a verified block, returning the events describing any change
+// to the best chain
+func (l *Ledger) addBlock(b Block) ([]Event, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	if _, ok := l.blocks[b.Hash()]; ok {
+		return nil, ErrKnownBlock
+	}
+
+	if b.Timestamp > l.now().Add(MaxFutureBlockTime).Unix() {
+		return nil, ErrTimestampTooNew
+	}
+
 	if _, ok := l.blocks[b.PrevBlock]; !ok {
-		return ErrPrevBlockNotFound{hash: b.PrevBlock}
+		return nil, ErrPrevBlockNotFound{hash: b.PrevBlock}
 	}
 
 	h, ok := l.getHead(b.PrevBlock)
@@ -213,17 +524,110 @@ func (l *Ledger) AddBlock(b Block) error {
 		h = l.headFromBlock(b.PrevBlock)
 	}
 
-	err := h.Update(&b)
-	if err != nil {
-		return err
+	// Update a copy, so nothing changes if the block can't be stored
+	next := *h
+	if err := next.Update(&b); err != nil {
+		return nil, err
+	}
+
+	if l.store != nil {
+		if err := l.store.Put(&b); err != nil {
+			return nil, fmt.Errorf("storing block: %w", err)
+		}
+	}
+
+	// Extending the best chain changes l.head in place, so remember where it was
+	oldHead, oldLength := l.head.block, l.head.length
+
+	*h = next
+	if !ok {
+		l.heads = append(l.heads, h)
 	}
-	if h.length > l.head.length {
+	if h.betterThan(l.head) {
 		l.head = h
 	}
 
 	l.blocks[b.Hash()] = &b
 
-	return nil
+	if l.head.block == oldHead {
+		return nil, nil
+	}
+
+	return l.reorgEvents(oldHead, oldLength, l.head.block, l.head.length), nil
+}
+
+// Block returns a known block
+func (l *Ledger) Block(hash [32]byte) (Block, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	b, ok := l.blocks[hash]
+	if !ok {
+		return Block{}, false
+	}
+	return b.Clone(), true
+}
+
+// Header returns the header of a known block
+func (l *Ledger) Header(hash [32]byte) (BlockHeader, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	b, ok := l.blocks[hash]
+	if !ok {
+		return BlockHeader{}, false
+	}
+	return b.BlockHeader.Clone(), true
+}
+
+// Locator describes the best chain to a peer, so it can find where its own
+// chain diverges. It lists the most recent blocks, then steps back
+// exponentially further, ending with the genesis block.
+func (l *Ledger) Locator() [][32]byte {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	chain := l.getChain(l.head.block.Hash())
+
+	locator := [][32]byte{}
+	step := 1
+	for i := 0; i < len(chain)-1; i += step {
+		locator = append(locator, chain[i].Hash())
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+
+	return append(locator, l.genesis)
+}
+
+// HeadersAfter returns up to limit headers from the best chain, following the
+// first locator hash which is on it. If none are, they follow the genesis
+// block.
+func (l *Ledger) HeadersAfter(locator [][32]byte, limit int) []BlockHeader {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	chain := l.getChain(l.head.block.Hash())
+	slices.Reverse(chain)
+
+	heights := make(map[[32]byte]int, len(chain))
+	for i, b := range chain {
+		heights[b.Hash()] = i
+	}
+
+	start := 0
+	for _, hash := range locator {
+		if height, ok := heights[hash]; ok {
+			start = height
+			break
+		}
+	}
+
+	headers := []BlockHeader{}
+	for _, b := range chain[start+1 : min(start+1+limit, len(chain))] {
+		headers = append(headers, b.BlockHeader.Clone())
+	}
+
+	return headers
 }
 
 func (l *Ledger) Head() *Block {
@@ -238,3 +642,11 @@ func (l *Ledger) Balance(pubkey ed25519.PublicKey) uint64 {
 	defer l.mu.RUnlock()
 	return l.head.balances.Get(pubkey)
 }
+
+// Nonce returns the nonce the next transaction sent by pubkey must carry on
+// the best chain
+func (l *Ledger) Nonce(pubkey ed25519.PublicKey) uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.head.balances.Nonce(pubkey)
+}
@@ -1,9 +1,14 @@
 package blockchain_test
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"errors"
+	"math"
 	"testing"
+	"time"
 
+	"github.com/holiman/uint256"
 	"github.com/zakkbob/go-blockchain/internal/blockchain"
 )
 
@@ -31,25 +36,39 @@ func TestLedgerTransaction(t *testing.T) {
 	}{
 		{
 			name:                "Valid transaction",
-			tx:                  miner1.NewTransaction(miner2.PublicKey(), 8),
+			tx:                  miner1.NewTransaction(miner2.PublicKey(), 8, 0, 0),
 			wantErrIs:           nil,
 			wantMinerOneBalance: 12,
 			wantMinerTwoBalance: 8,
 		},
 		{
 			name:                "Insufficient balance",
-			tx:                  miner1.NewTransaction(miner2.PublicKey(), 12),
+			tx:                  miner1.NewTransaction(miner2.PublicKey(), 12, 0, 0),
 			wantErrIs:           blockchain.ErrInsufficientBalance,
 			wantMinerOneBalance: 10,
 			wantMinerTwoBalance: 0,
 		},
 		{
 			name:                "Transaction of zero",
-			tx:                  miner1.NewTransaction(miner2.PublicKey(), 0),
+			tx:                  miner1.NewTransaction(miner2.PublicKey(), 0, 0, 0),
 			wantErrAs:           &blockchain.ErrInvalidTransaction{},
 			wantMinerOneBalance: 10,
 			wantMinerTwoBalance: 0,
 		},
+		{
+			name:                "Insufficient balance for fee",
+			tx:                  miner1.NewTransaction(miner2.PublicKey(), 8, 3, 0),
+			wantErrIs:           blockchain.ErrInsufficientBalance,
+			wantMinerOneBalance: 10,
+			wantMinerTwoBalance: 0,
+		},
+		{
+			name:                "Skipped nonce",
+			tx:                  miner1.NewTransaction(miner2.PublicKey(), 8, 0, 1),
+			wantErrIs:           blockchain.ErrInvalidNonce,
+			wantMinerOneBalance: 10,
+			wantMinerTwoBalance: 0,
+		},
 		{
 			name: "Unsigned transaction",
 			tx: blockchain.Transaction{
@@ -85,25 +104,70 @@ func TestLedgerTransaction(t *testing.T) {
 	}
 }
 
-func TestLedgerNewHead(t *testing.T) {
+func TestLedgerTransactionFee(t *testing.T) {
+	sender := MustGenerateTestAddress(t)
+	receiver := MustGenerateTestAddress(t)
 	miner := MustGenerateTestAddress(t)
 
+	l, _ := MustCreateTestLedger(t)
+
+	MustAddNewTestBlock(t, l, []blockchain.Transaction{}, sender.PublicKey())
+	MustAddNewTestBlock(t, l, []blockchain.Transaction{sender.NewTransaction(receiver.PublicKey(), 5, 2, 0)}, miner.PublicKey())
+
+	AssertAddressBalance(t, l, sender, 3)
+	AssertAddressBalance(t, l, receiver, 5)
+	AssertAddressBalance(t, l, miner, 12)
+}
+
+func TestLedgerTransactionReplay(t *testing.T) {
+	miner1 := MustGenerateTestAddress(t)
+	miner2 := MustGenerateTestAddress(t)
+
+	l, _ := MustCreateTestLedger(t)
+
+	MustAddNewTestBlock(t, l, []blockchain.Transaction{}, miner1.PublicKey())
+
+	tx := miner1.NewTransaction(miner2.PublicKey(), 3, 0, 0)
+	MustAddNewTestBlock(t, l, []blockchain.Transaction{tx}, miner2.PublicKey())
+
+	_, err := AddNewTestBlock(t, l, []blockchain.Transaction{tx}, miner2.PublicKey())
+	if !errors.Is(err, blockchain.ErrInvalidNonce) {
+		t.Errorf("AddBlock should return %v when a transaction is replayed, not %v", blockchain.ErrInvalidNonce, err)
+	}
+
+	MustAddNewTestBlock(t, l, []blockchain.Transaction{miner1.NewTransaction(miner2.PublicKey(), 3, 0, 1)}, miner2.PublicKey())
+
+	AssertAddressBalance(t, l, miner1, 4)
+	AssertAddressBalance(t, l, miner2, 26)
+}
+
+func TestLedgerKnownBlock(t *testing.T) {
+	miner := MustGenerateTestAddress(t)
+
+	l, _ := MustCreateTestLedger(t)
+
+	b := MustAddNewTestBlock(t, l, []blockchain.Transaction{}, miner.PublicKey())
+	if err := l.AddBlock(*b); !errors.Is(err, blockchain.ErrKnownBlock) {
+		t.Errorf("AddBlock should return %v, not %v", blockchain.ErrKnownBlock, err)
+	}
+
+	AssertAddressBalance(t, l, miner, 10)
+}
+
+func TestLedgerNewHead(t *testing.T) {
+	minerA := MustGenerateTestAddress(t)
+	minerB := MustGenerateTestAddress(t)
+
 	l, genesis := MustCreateTestLedger(t)
 
-	block1 := blockchain.NewBlock(genesis.Hash(), []blockchain.Transaction{}, 0, miner.PublicKey())
-	block1.Mine()
+	block1 := NewTestBlock(t, genesis, []blockchain.Transaction{}, 0, minerA.PublicKey())
 
-	blockA2 := blockchain.NewBlock(block1.Hash(), []blockchain.Transaction{}, 0, miner.PublicKey())
-	blockA2.Mine()
-	blockA3 := blockchain.NewBlock(blockA2.Hash(), []blockchain.Transaction{}, 0, miner.PublicKey())
-	blockA3.Mine()
-	blockA4 := blockchain.NewBlock(blockA2.Hash(), []blockchain.Transaction{}, 0, miner.PublicKey())
-	blockA4.Mine()
+	blockA2 := NewTestBlock(t, &block1, []blockchain.Transaction{}, 0, minerA.PublicKey())
+	blockA3 := NewTestBlock(t, &blockA2, []blockchain.Transaction{}, 0, minerA.PublicKey())
+	blockA4 := NewTestBlock(t, &blockA3, []blockchain.Transaction{}, 0, minerA.PublicKey())
 
-	blockB2 := blockchain.NewBlock(block1.Hash(), []blockchain.Transaction{}, 0, miner.PublicKey())
-	blockB2.Mine()
-	blockB3 := blockchain.NewBlock(blockB2.Hash(), []blockchain.Transaction{}, 0, miner.PublicKey())
-	blockB3.Mine()
+	blockB2 := NewTestBlock(t, &block1, []blockchain.Transaction{}, 0, minerB.PublicKey())
+	blockB3 := NewTestBlock(t, &blockB2, []blockchain.Transaction{}, 0, minerB.PublicKey())
 
 	MustAddTestBlock(t, l, block1)
 	if l.Head().Hash() != block1.Hash() {
@@ -116,8 +180,8 @@ func TestLedgerNewHead(t *testing.T) {
 	}
 
 	MustAddTestBlock(t, l, blockB2)
-	if l.Head().Hash() != blockA2.Hash() {
-		t.Error("head should be blockA2")
+	if l.Head().Hash() != lowestHash(blockA2, blockB2) {
+		t.Error("head should be whichever of blockA2 and blockB2 has the lowest hash")
 	}
 
 	MustAddTestBlock(t, l, blockB3)
@@ -126,13 +190,559 @@ func TestLedgerNewHead(t *testing.T) {
 	}
 
 	MustAddTestBlock(t, l, blockA3)
-	if l.Head().Hash() != blockB3.Hash() {
-		t.Error("head should be blockB3")
+	if l.Head().Hash() != lowestHash(blockA3, blockB3) {
+		t.Error("head should be whichever of blockA3 and blockB3 has the lowest hash")
 	}
 
 	MustAddTestBlock(t, l, blockA4)
 	if l.Head().Hash() != blockA4.Hash() {
-		t.Error("head should be blockB3")
+		t.Error("head should be blockA4")
+	}
+}
+
+func TestLedgerNewHeadMostWork(t *testing.T) {
+	minerA := MustGenerateTestAddress(t)
+	minerB := MustGenerateTestAddress(t)
+
+	// Retargets after every block, based on the time between the previous two
+	params := NewTestParams()
+	params.BlockInterval = 10 * time.Second
+	params.RetargetWindow = 1
+	l, err := blockchain.NewLedger(params, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis := l.Head()
+
+	// A long chain of slow, easy blocks
+	prev := genesis
+	for range 5 {
+		b := newTestBlockAt(prev, prev.Timestamp+20, 0, minerA.PublicKey())
+		MustAddTestBlock(t, l, b)
+		prev = &b
+	}
+
+	// A short chain of fast blocks, which become harder to mine
+	prev = genesis
+	for _, difficulty := range []int{0, 2, 4} {
+		b := newTestBlockAt(prev, prev.Timestamp+1, difficulty, minerB.PublicKey())
+		MustAddTestBlock(t, l, b)
+		prev = &b
+	}
+
+	if l.Head().Hash() != prev.Hash() {
+		t.Error("head should be the end of the short chain, as it has the most work")
+	}
+	if l.Length() != 4 {
+		t.Errorf("expected length of 4; got %d", l.Length())
 	}
+}
+
+func TestLedgerNewHeadTieBreak(t *testing.T) {
+	minerA := MustGenerateTestAddress(t)
+	minerB := MustGenerateTestAddress(t)
+
+	for _, reverse := range []bool{false, true} {
+		l, genesis := MustCreateTestLedger(t)
 
+		blockA := NewTestBlock(t, genesis, []blockchain.Transaction{}, 0, minerA.PublicKey())
+		blockB := NewTestBlock(t, genesis, []blockchain.Transaction{}, 0, minerB.PublicKey())
+
+		if reverse {
+			MustAddTestBlock(t, l, blockB)
+			MustAddTestBlock(t, l, blockA)
+		} else {
+			MustAddTestBlock(t, l, blockA)
+			MustAddTestBlock(t, l, blockB)
+		}
+
+		if l.Head().Hash() != lowestHash(blockA, blockB) {
+			t.Errorf("head should be the block with the lowest hash (reverse order: %t)", reverse)
+		}
+	}
+}
+
+func TestLedgerRetarget(t *testing.T) {
+	miner := MustGenerateTestAddress(t)
+
+	tests := []struct {
+		name            string
+		spacing         int64
+		startDifficulty int
+		wantDifficulty  int
+	}{
+		{
+			name:            "On target",
+			spacing:         10,
+			startDifficulty: 2,
+			wantDifficulty:  2,
+		},
+		{
+			name:            "Too fast",
+			spacing:         4,
+			startDifficulty: 2,
+			wantDifficulty:  3,
+		},
+		{
+			name:            "Much too fast",
+			spacing:         1,
+			startDifficulty: 2,
+			wantDifficulty:  4,
+		},
+		{
+			name:            "Too slow",
+			spacing:         25,
+			startDifficulty: 2,
+			wantDifficulty:  1,
+		},
+		{
+			name:            "Too slow at minimum difficulty",
+			spacing:         60,
+			startDifficulty: 0,
+			wantDifficulty:  0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := NewTestParams()
+			params.BlockInterval = 10 * time.Second
+			params.RetargetWindow = 4
+			params.Genesis.Difficulty = tt.startDifficulty
+			if err := params.Genesis.Mine(); err != nil {
+				t.Fatal(err)
+			}
+
+			l, err := blockchain.NewLedger(params, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			prev := l.Head()
+			for range 7 {
+				if l.CalculateFutureDifficulty() != tt.startDifficulty {
+					t.Fatalf("difficulty should not change until the end of the window")
+				}
+				b := newTestBlockAt(prev, prev.Timestamp+tt.spacing, tt.startDifficulty, miner.PublicKey())
+				MustAddTestBlock(t, l, b)
+				prev = &b
+			}
+
+			// The first retarget is at height 8, using the 4 intervals before it
+			if got := l.CalculateFutureDifficulty(); got != tt.wantDifficulty {
+				t.Fatalf("expected difficulty %d; got %d", tt.wantDifficulty, got)
+			}
+
+			wrong := newTestBlockAt(prev, prev.Timestamp+tt.spacing, tt.wantDifficulty+1, miner.PublicKey())
+			if err := l.AddBlock(wrong); !errors.Is(err, blockchain.ErrUnexpectedDifficulty) {
+				t.Errorf("AddBlock should return %v, not %v", blockchain.ErrUnexpectedDifficulty, err)
+			}
+
+			b := newTestBlockAt(prev, prev.Timestamp+tt.spacing, tt.wantDifficulty, miner.PublicKey())
+			MustAddTestBlock(t, l, b)
+		})
+	}
+}
+
+func TestLedgerTimestamp(t *testing.T) {
+	miner := MustGenerateTestAddress(t)
+
+	l, genesis := MustCreateTestLedger(t)
+
+	now := time.Unix(genesis.Timestamp, 0).Add(time.Hour)
+	l.SetClock(func() time.Time { return now })
+
+	// Dated 0, 10, 20, ..., so the median of the last 11 is 50
+	prev := genesis
+	for range 10 {
+		b := newTestBlockAt(prev, prev.Timestamp+10, 0, miner.PublicKey())
+		MustAddTestBlock(t, l, b)
+		prev = &b
+	}
+
+	tests := []struct {
+		name      string
+		timestamp int64
+		wantErrIs error
+	}{
+		{
+			name:      "At median time",
+			timestamp: genesis.Timestamp + 50,
+			wantErrIs: blockchain.ErrTimestampTooOld,
+		},
+		{
+			name:      "After median time",
+			timestamp: genesis.Timestamp + 51,
+		},
+		{
+			name:      "At future limit",
+			timestamp: now.Add(blockchain.MaxFutureBlockTime).Unix(),
+		},
+		{
+			name:      "Beyond future limit",
+			timestamp: now.Add(blockchain.MaxFutureBlockTime).Unix() + 1,
+			wantErrIs: blockchain.ErrTimestampTooNew,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBlockAt(prev, tt.timestamp, 0, miner.PublicKey())
+
+			err := l.AddBlock(b)
+			if !errors.Is(err, tt.wantErrIs) {
+				t.Errorf("AddBlock should return %v, not %v", tt.wantErrIs, err)
+			}
+		})
+	}
+}
+
+func TestLedgerHeaderRules(t *testing.T) {
+	miner := MustGenerateTestAddress(t)
+
+	tests := []struct {
+		name      string
+		change    func(b *blockchain.Block)
+		wantErrIs error
+	}{
+		{
+			name:      "Unsupported version",
+			change:    func(b *blockchain.Block) { b.Version = blockchain.BlockVersion + 1 },
+			wantErrIs: blockchain.ErrUnsupportedVersion,
+		},
+		{
+			name:      "Genesis flag",
+			change:    func(b *blockchain.Block) { b.Genesis = true },
+			wantErrIs: blockchain.ErrUnexpectedGenesis,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, genesis := MustCreateTestLedger(t)
+
+			b := NewTestBlock(t, genesis, []blockchain.Transaction{}, 0, miner.PublicKey())
+			tt.change(&b)
+			b.Mine()
+
+			if err := l.AddBlock(b); !errors.Is(err, tt.wantErrIs) {
+				t.Errorf("AddBlock should return %v, not %v", tt.wantErrIs, err)
+			}
+		})
+	}
+}
+
+func TestLedgerCoinbase(t *testing.T) {
+	miner := MustGenerateTestAddress(t)
+	sender := MustGenerateTestAddress(t)
+	receiver := MustGenerateTestAddress(t)
+
+	tests := []struct {
+		name         string
+		coinbase     func(c *blockchain.Transaction)
+		wantErrIs    error
+		wantErrAs    any
+		wantReceived uint64
+		wantSupply   uint64
+	}{
+		{
+			name:         "Full reward and fees",
+			coinbase:     func(c *blockchain.Transaction) {},
+			wantReceived: 10 + 2,
+			wantSupply:   20,
+		},
+		{
+			name:         "Less than allowed",
+			coinbase:     func(c *blockchain.Transaction) { c.Value = 4 },
+			wantReceived: 4,
+			wantSupply:   10 - 2 + 4,
+		},
+		{
+			name:         "Extra data",
+			coinbase:     func(c *blockchain.Transaction) { c.Data = []byte("hello") },
+			wantReceived: 10 + 2,
+			wantSupply:   20,
+		},
+		{
+			name:      "More than allowed",
+			coinbase:  func(c *blockchain.Transaction) { c.Value++ },
+			wantErrIs: blockchain.ErrCoinbaseTooLarge,
+		},
+		{
+			name: "Split between outputs",
+			coinbase: func(c *blockchain.Transaction) {
+				c.Value = 4
+				c.Outputs = []blockchain.Output{{Receiver: receiver.PublicKey(), Value: 5}, {Receiver: receiver.PublicKey(), Value: 3}}
+			},
+			wantReceived: 10 + 2,
+			wantSupply:   20,
+		},
+		{
+			name: "Outputs more than allowed",
+			coinbase: func(c *blockchain.Transaction) {
+				c.Value = 4
+				c.Outputs = []blockchain.Output{{Receiver: receiver.PublicKey(), Value: 9}}
+			},
+			wantErrIs: blockchain.ErrCoinbaseTooLarge,
+		},
+		{
+			name: "Outputs overflow",
+			coinbase: func(c *blockchain.Transaction) {
+				c.Outputs = []blockchain.Output{{Receiver: receiver.PublicKey(), Value: math.MaxUint64}}
+			},
+			wantErrAs: &blockchain.ErrInvalidTransaction{},
+		},
+		{
+			name: "Too many outputs",
+			coinbase: func(c *blockchain.Transaction) {
+				c.Value = 0
+				for range blockchain.MaxCoinbaseOutputs + 1 {
+					c.Outputs = append(c.Outputs, blockchain.Output{Receiver: receiver.PublicKey(), Value: 1})
+				}
+			},
+			wantErrAs: &blockchain.ErrInvalidTransaction{},
+		},
+		{
+			name:      "Wrong height",
+			coinbase:  func(c *blockchain.Transaction) { c.Nonce++ },
+			wantErrIs: blockchain.ErrCoinbaseHeight,
+		},
+		{
+			name:      "Too much data",
+			coinbase:  func(c *blockchain.Transaction) { c.Data = make([]byte, blockchain.MaxCoinbaseData+1) },
+			wantErrAs: &blockchain.ErrInvalidTransaction{},
+		},
+		{
+			name:      "Fee",
+			coinbase:  func(c *blockchain.Transaction) { c.Fee = 1 },
+			wantErrAs: &blockchain.ErrInvalidTransaction{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, _ := MustCreateTestLedger(t)
+			MustAddNewTestBlock(t, l, []blockchain.Transaction{}, sender.PublicKey())
+
+			// Paid to someone other than the block's miner
+			prev := l.Head()
+			tx := sender.NewTransaction(miner.PublicKey(), 1, 2, 0)
+			coinbase := NewTestCoinbase(NewTestParams(), prev, []blockchain.Transaction{tx}, receiver.PublicKey())
+			tt.coinbase(&coinbase)
+
+			b := blockchain.NewBlock(prev.Hash(), []blockchain.Transaction{coinbase, tx}, 0, miner.PublicKey())
+			b.Timestamp = prev.Timestamp + 1
+			b.Mine()
+
+			err := l.AddBlock(b)
+			if tt.wantErrIs != nil && !errors.Is(err, tt.wantErrIs) {
+				t.Errorf("AddBlock should return %v, not %v", tt.wantErrIs, err)
+			}
+			if tt.wantErrAs != nil && !errors.As(err, tt.wantErrAs) {
+				t.Errorf("AddBlock should return error of type %v, not %v", tt.wantErrAs, err)
+			}
+			if tt.wantErrIs != nil || tt.wantErrAs != nil {
+				return
+			}
+			if err != nil {
+				t.Fatalf("AddBlock should not return an error: %v", err)
+			}
+
+			AssertAddressBalance(t, l, receiver, tt.wantReceived)
+			AssertAddressBalance(t, l, miner, 1)
+			if l.Supply() != tt.wantSupply {
+				t.Errorf("expected supply of %d; got %d", tt.wantSupply, l.Supply())
+			}
+		})
+	}
+}
+
+func TestLedgerMissingCoinbase(t *testing.T) {
+	miner := MustGenerateTestAddress(t)
+	sender := MustGenerateTestAddress(t)
+
+	l, _ := MustCreateTestLedger(t)
+	MustAddNewTestBlock(t, l, []blockchain.Transaction{}, sender.PublicKey())
+	prev := l.Head()
+
+	tx := sender.NewTransaction(miner.PublicKey(), 1, 0, 0)
+	coinbase := NewTestCoinbase(NewTestParams(), prev, nil, miner.PublicKey())
+
+	for name, txs := range map[string][]blockchain.Transaction{
+		"empty":           {},
+		"no coinbase":     {tx},
+		"coinbase second": {tx, coinbase},
+		"second coinbase": {coinbase, coinbase},
+	} {
+		b := blockchain.NewBlock(prev.Hash(), txs, 0, miner.PublicKey())
+		b.Timestamp = prev.Timestamp + 1
+		b.Mine()
+
+		err := l.AddBlock(b)
+		var invalid blockchain.ErrInvalidTransaction
+		if !errors.Is(err, blockchain.ErrMissingCoinbase) && !errors.As(err, &invalid) {
+			t.Errorf("%s: AddBlock should reject the block, got %v", name, err)
+		}
+	}
+}
+
+func newTestBlockAt(prev *blockchain.Block, timestamp int64, difficulty int, miner ed25519.PublicKey) blockchain.Block {
+	txs := []blockchain.Transaction{NewTestCoinbase(NewTestParams(), prev, nil, miner)}
+	b := blockchain.NewBlock(prev.Hash(), txs, difficulty, miner)
+	b.Timestamp = timestamp
+	b.Mine()
+	return b
+}
+
+func lowestHash(a blockchain.Block, b blockchain.Block) [32]byte {
+	aHash := a.Hash()
+	bHash := b.Hash()
+	if bytes.Compare(aHash[:], bHash[:]) < 0 {
+		return aHash
+	}
+	return bHash
+}
+
+func TestLedgerLocator(t *testing.T) {
+	miner := MustGenerateTestAddress(t)
+
+	l, genesis := MustCreateTestLedger(t)
+
+	locator := l.Locator()
+	if len(locator) != 1 || locator[0] != genesis.Hash() {
+		t.Fatalf("locator of a new ledger should only hold the genesis block, got %d hashes", len(locator))
+	}
+
+	hashes := [][32]byte{genesis.Hash()}
+	for range 30 {
+		b := MustAddNewTestBlock(t, l, []blockchain.Transaction{}, miner.PublicKey())
+		hashes = append(hashes, b.Hash())
+	}
+
+	// The 10 most recent blocks, then 2, 4, 8... blocks apart
+	expected := [][32]byte{}
+	for _, height := range []int{30, 29, 28, 27, 26, 25, 24, 23, 22, 21, 19, 15, 7, 0} {
+		expected = append(expected, hashes[height])
+	}
+
+	locator = l.Locator()
+	if len(locator) != len(expected) {
+		t.Fatalf("expected locator of %d hashes; got %d", len(expected), len(locator))
+	}
+	for i := range expected {
+		if locator[i] != expected[i] {
+			t.Errorf("locator hash %d should be %x, not %x", i, expected[i], locator[i])
+		}
+	}
+}
+
+func TestLedgerHeadersAfter(t *testing.T) {
+	miner := MustGenerateTestAddress(t)
+	other := MustGenerateTestAddress(t)
+
+	l, genesis := MustCreateTestLedger(t)
+
+	hashes := [][32]byte{genesis.Hash()}
+	for range 5 {
+		b := MustAddNewTestBlock(t, l, []blockchain.Transaction{}, miner.PublicKey())
+		hashes = append(hashes, b.Hash())
+	}
+
+	// A block the ledger doesn't know, such as one from a peer's fork
+	unknown := NewTestBlock(t, genesis, []blockchain.Transaction{}, 0, other.PublicKey())
+
+	tests := []struct {
+		name     string
+		locator  [][32]byte
+		limit    int
+		expected [][32]byte
+	}{
+		{"from genesis", [][32]byte{hashes[0]}, 10, hashes[1:]},
+		{"limited", [][32]byte{hashes[0]}, 2, hashes[1:3]},
+		{"first known hash", [][32]byte{unknown.Hash(), hashes[3], hashes[1]}, 10, hashes[4:]},
+		{"up to date", [][32]byte{hashes[5]}, 10, [][32]byte{}},
+		{"nothing known", [][32]byte{unknown.Hash()}, 10, hashes[1:]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := l.HeadersAfter(tt.locator, tt.limit)
+			if len(headers) != len(tt.expected) {
+				t.Fatalf("expected %d headers; got %d", len(tt.expected), len(headers))
+			}
+			for i, h := range headers {
+				if h.Hash() != tt.expected[i] {
+					t.Errorf("header %d should be %x, not %x", i, tt.expected[i], h.Hash())
+				}
+			}
+		})
+	}
+}
+
+func TestLedgerWorkAt(t *testing.T) {
+	minerA := MustGenerateTestAddress(t)
+	minerB := MustGenerateTestAddress(t)
+
+	l, genesis := MustCreateTestLedger(t)
+
+	block1 := NewTestBlock(t, genesis, []blockchain.Transaction{}, 0, minerA.PublicKey())
+	blockA2 := NewTestBlock(t, &block1, []blockchain.Transaction{}, 0, minerA.PublicKey())
+	blockB2 := NewTestBlock(t, &block1, []blockchain.Transaction{}, 0, minerB.PublicKey())
+	MustAddTestBlock(t, l, block1)
+	MustAddTestBlock(t, l, blockA2)
+	MustAddTestBlock(t, l, blockB2)
+
+	expected := new(uint256.Int).Add(genesis.Work(), block1.Work())
+
+	if work, ok := l.WorkAt(block1.Hash()); !ok || !work.Eq(expected) {
+		t.Errorf("expected work of %v at block1; got %v", expected, work)
+	}
+
+	expected.Add(expected, blockA2.Work())
+	if work, ok := l.WorkAt(blockA2.Hash()); !ok || !work.Eq(expected) {
+		t.Errorf("expected work of %v at blockA2; got %v", expected, work)
+	}
+
+	if work, ok := l.WorkAt(l.HeadHash()); !ok || !work.Eq(l.Work()) {
+		t.Errorf("work at the head should be the ledger's work, got %v", work)
+	}
+
+	if _, ok := l.WorkAt([32]byte{1}); ok {
+		t.Error("WorkAt should not find an unknown block")
+	}
+
+	if length, ok := l.LengthAt(blockA2.Hash()); !ok || length != 3 {
+		t.Errorf("expected length of 3 at blockA2; got %d", length)
+	}
+	if length, ok := l.LengthAt(genesis.Hash()); !ok || length != 1 {
+		t.Errorf("expected length of 1 at genesis; got %d", length)
+	}
+	if _, ok := l.LengthAt([32]byte{1}); ok {
+		t.Error("LengthAt should not find an unknown block")
+	}
+}
+
+func TestLedgerNextBlockTemplate(t *testing.T) {
+	miner := MustGenerateTestAddress(t)
+
+	l, _ := MustCreateTestLedger(t)
+	MustAddNewTestBlock(t, l, []blockchain.Transaction{}, miner.PublicKey())
+
+	template := l.NextBlockTemplate()
+
+	if template.PrevBlock != l.HeadHash() || template.Height != l.Length() {
+		t.Errorf("template should build on the head, got height %d", template.Height)
+	}
+	if template.Difficulty != l.CalculateFutureDifficulty() || template.MedianTimePast != l.MedianTimePast() {
+		t.Error("template should have the next block's difficulty and median time")
+	}
+	if template.Balances.Get(miner.PublicKey()) != l.Balance(miner.PublicKey()) {
+		t.Error("template should have the head's balances")
+	}
+
+	// The balances are a copy
+	template.Balances.Increase(miner.PublicKey(), 1)
+	if l.Balance(miner.PublicKey()) == template.Balances.Get(miner.PublicKey()) {
+		t.Error("changing the template's balances should not change the ledger")
+	}
 }
@@ -0,0 +1,138 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"errors"
+)
+
+var (
+	ErrTransactionNotInBlock = errors.New("transaction is not in block")
+)
+
+// Leaves and inner nodes are hashed with different prefixes, so an inner node
+// can never be passed off as a transaction
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+// MerkleProof proves a transaction is committed to by a Merkle root, without
+// needing the rest of the block's transactions
+type MerkleProof struct {
+	Index  int        `json:"index"`  // Position of the transaction in the block
+	Total  int        `json:"total"`  // Number of transactions in the block
+	Hashes [][32]byte `json:"hashes"` // Sibling hashes, from the leaves up to the root
+}
+
+func merkleLeaf(txHash [32]byte) [32]byte {
+	return sha256.Sum256(append([]byte{merkleLeafPrefix}, txHash[:]...))
+}
+
+func merkleNode(left [32]byte, right [32]byte) [32]byte {
+	data := make([]byte, 0, 1+2*len(left))
+	data = append(data, merkleNodePrefix)
+	data = append(data, left[:]...)
+	data = append(data, right[:]...)
+	return sha256.Sum256(data)
+}
+
+// merkleLevels returns every level of the tree, from the leaves to the root.
+// A node without a sibling is promoted to the next level unchanged.
+func merkleLevels(txs []Transaction) [][][32]byte {
+	level := make([][32]byte, len(txs))
+	for i, tx := range txs {
+		level[i] = merkleLeaf(tx.Hash())
+	}
+
+	levels := [][][32]byte{level}
+
+	for len(level) > 1 {
+		next := make([][32]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			next = append(next, merkleNode(level[i], level[i+1]))
+		}
+
+		levels = append(levels, next)
+		level = next
+	}
+
+	return levels
+}
+
+// MerkleRoot returns the root of the Merkle tree over txs, or the zero hash if
+// there are none
+func MerkleRoot(txs []Transaction) [32]byte {
+	if len(txs) == 0 {
+		return [32]byte{}
+	}
+
+	levels := merkleLevels(txs)
+	return levels[len(levels)-1][0]
+}
+
+// MerkleProof returns a proof that the transaction with txHash is in the block
+func (b *Block) MerkleProof(txHash [32]byte) (MerkleProof, error) {
+	index := -1
+	for i, tx := range b.Transactions {
+		if tx.Hash() == txHash {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return MerkleProof{}, ErrTransactionNotInBlock
+	}
+
+	proof := MerkleProof{
+		Index:  index,
+		Total:  len(b.Transactions),
+		Hashes: [][32]byte{},
+	}
+
+	levels := merkleLevels(b.Transactions)
+	for _, level := range levels[:len(levels)-1] {
+		sibling := index ^ 1
+		if sibling < len(level) {
+			proof.Hashes = append(proof.Hashes, level[sibling])
+		}
+		index /= 2
+	}
+
+	return proof, nil
+}
+
+// Verify reports whether the proof shows the transaction with txHash is
+// committed to by root
+func (p MerkleProof) Verify(root [32]byte, txHash [32]byte) bool {
+	if p.Index < 0 || p.Index >= p.Total {
+		return false
+	}
+
+	hash := merkleLeaf(txHash)
+	hashes := p.Hashes
+	index, width := p.Index, p.Total
+
+	for width > 1 {
+		sibling := index ^ 1
+		if sibling < width {
+			if len(hashes) == 0 {
+				return false
+			}
+			if index%2 == 0 {
+				hash = merkleNode(hash, hashes[0])
+			} else {
+				hash = merkleNode(hashes[0], hash)
+			}
+			hashes = hashes[1:]
+		}
+
+		index /= 2
+		width = (width + 1) / 2
+	}
+
+	return len(hashes) == 0 && hash == root
+}
@@ -0,0 +1,76 @@
+package blockchain_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/zakkbob/go-blockchain/internal/blockchain"
+)
+
+func TestMerkleProof(t *testing.T) {
+	sender := MustGenerateTestAddress(t)
+	receiver := MustGenerateTestAddress(t)
+
+	for n := 1; n <= 9; n++ {
+		txs := make([]blockchain.Transaction, n)
+		for i := range txs {
+			txs[i] = sender.NewTransaction(receiver.PublicKey(), 1, 0, uint64(i))
+		}
+
+		b := blockchain.NewBlock([32]byte{}, txs, 0, receiver.PublicKey())
+
+		for i, tx := range txs {
+			proof, err := b.MerkleProof(tx.Hash())
+			if err != nil {
+				t.Fatalf("MerkleProof should not return an error: %v", err)
+			}
+
+			if !proof.Verify(b.MerkleRoot, tx.Hash()) {
+				t.Errorf("proof for transaction %d of %d should be valid", i, n)
+			}
+
+			other := txs[(i+1)%n]
+			if n > 1 && proof.Verify(b.MerkleRoot, other.Hash()) {
+				t.Errorf("proof for transaction %d of %d should not be valid for another transaction", i, n)
+			}
+
+			if len(proof.Hashes) > 0 {
+				proof.Hashes[0][0] ^= 1
+				if proof.Verify(b.MerkleRoot, tx.Hash()) {
+					t.Errorf("tampered proof for transaction %d of %d should not be valid", i, n)
+				}
+			}
+		}
+	}
+}
+
+func TestMerkleProofMissingTransaction(t *testing.T) {
+	sender := MustGenerateTestAddress(t)
+	receiver := MustGenerateTestAddress(t)
+
+	tx := sender.NewTransaction(receiver.PublicKey(), 1, 0, 0)
+	missing := sender.NewTransaction(receiver.PublicKey(), 1, 0, 1)
+
+	b := blockchain.NewBlock([32]byte{}, []blockchain.Transaction{tx}, 0, receiver.PublicKey())
+
+	_, err := b.MerkleProof(missing.Hash())
+	if !errors.Is(err, blockchain.ErrTransactionNotInBlock) {
+		t.Errorf("MerkleProof should return %v, not %v", blockchain.ErrTransactionNotInBlock, err)
+	}
+}
+
+func TestMerkleRootMismatch(t *testing.T) {
+	sender := MustGenerateTestAddress(t)
+	receiver := MustGenerateTestAddress(t)
+
+	tx1 := sender.NewTransaction(receiver.PublicKey(), 1, 0, 0)
+	tx2 := sender.NewTransaction(receiver.PublicKey(), 1, 0, 1)
+
+	b := blockchain.NewBlock([32]byte{}, []blockchain.Transaction{tx1, tx2}, 0, receiver.PublicKey())
+	b.Transactions[0], b.Transactions[1] = tx2, tx1
+	b.Mine()
+
+	if err := b.Verify(NewTestParams()); !errors.Is(err, blockchain.ErrMerkleRootMismatch) {
+		t.Errorf("Verify should return %v, not %v", blockchain.ErrMerkleRootMismatch, err)
+	}
+}
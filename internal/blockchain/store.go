@@ -0,0 +1,10 @@
+package blockchain
+
+// Store persists accepted blocks, so a ledger can be rebuilt after a restart
+type Store interface {
+	// Put saves a block. A block is always put after its parent.
+	Put(b *Block) error
+	// Blocks returns every saved block, in the order they were put
+	Blocks() ([]Block, error)
+	Close() error
+}
@@ -15,11 +15,35 @@ func MustAddTestBlock(t *testing.T, l *Ledger, b Block) {
 	}
 }
 
+// NewTestCoinbase returns the coinbase of a block on top of prev containing
+// txs, which pays the full reward and fees to miner
+func NewTestCoinbase(params *ChainParams, prev *Block, txs []Transaction, miner ed25519.PublicKey) Transaction {
+	height := prev.Height() + 1
+	value := params.BlockReward(height)
+	for _, tx := range txs {
+		value += tx.Fee
+	}
+	return NewCoinbase(miner, value, height, nil)
+}
+
+func newTestBlock(params *ChainParams, prev *Block, txs []Transaction, difficulty int, miner ed25519.PublicKey) Block {
+	txs = append([]Transaction{NewTestCoinbase(params, prev, txs, miner)}, txs...)
+	b := NewBlock(prev.Hash(), txs, difficulty, miner)
+	b.Timestamp = prev.Timestamp + 1
+	b.Mine()
+	return b
+}
+
+// NewTestBlock returns a mined block on top of prev, dated one second after
+// it, whose coinbase claims the regtest reward
+func NewTestBlock(t *testing.T, prev *Block, txs []Transaction, difficulty int, miner ed25519.PublicKey) Block {
+	t.Helper()
+	return newTestBlock(NewTestParams(), prev, txs, difficulty, miner)
+}
+
 func AddNewTestBlock(t *testing.T, l *Ledger, txs []Transaction, miner ed25519.PublicKey) (*Block, error) {
 	t.Helper()
-	head := l.Head()
-	b := NewBlock(head.Hash(), txs, 0, miner)
-	b.Mine()
+	b := newTestBlock(l.Params(), l.Head(), txs, l.CalculateFutureDifficulty(), miner)
 
 	return &b, l.AddBlock(b)
 }
@@ -44,7 +68,7 @@ func AssertAddressBalance(t *testing.T, l *Ledger, a Address, expected uint64) {
 
 func MustCreateTestLedger(t *testing.T) (*Ledger, *Block) {
 	t.Helper()
-	ledger, err := NewLedger(0)
+	ledger, err := NewLedger(NewTestParams(), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -60,3 +84,10 @@ func MustGenerateTestAddress(t *testing.T) Address {
 	}
 	return addr
 }
+
+// NewTestParams returns a fresh copy of the regtest params, which tests are
+// free to modify
+func NewTestParams() *ChainParams {
+	params, _ := NetworkParams("regtest")
+	return params
+}
@@ -5,8 +5,12 @@ import (
 )
 
 var MustAddTestBlock = blockchain.MustAddTestBlock
+var NewTestBlock = blockchain.NewTestBlock
+var NewTestCoinbase = blockchain.NewTestCoinbase
 var AddNewTestBlock = blockchain.AddNewTestBlock
 var MustAddNewTestBlock = blockchain.MustAddNewTestBlock
 var AssertAddressBalance = blockchain.AssertAddressBalance
 var MustCreateTestLedger = blockchain.MustCreateTestLedger
 var MustGenerateTestAddress = blockchain.MustGenerateTestAddress
+
+var NewTestParams = blockchain.NewTestParams
@@ -5,6 +5,7 @@ import (
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"slices"
 )
@@ -21,32 +22,100 @@ func (e ErrInvalidTransaction) Error() string {
 	return fmt.Sprintf("invalid transaction %+v", e.tx)
 }
 
+const (
+	MaxCoinbaseData    = 100 // Most extra data a coinbase transaction may carry
+	MaxCoinbaseOutputs = 16  // Most payments a coinbase may make on top of the one to its Receiver
+)
+
 type Transaction struct {
 	Sender    ed25519.PublicKey `json:"sender"`
 	Receiver  ed25519.PublicKey `json:"receiver"`
 	Value     uint64            `json:"value"`
+	Fee       uint64            `json:"fee"`               // paid to the miner of the including block
+	Nonce     uint64            `json:"nonce"`             // must equal the sender's next expected nonce, or the block height for a coinbase
+	Data      []byte            `json:"data,omitempty"`    // arbitrary, only allowed in a coinbase
+	Outputs   []Output          `json:"outputs,omitempty"` // further payments, only allowed in a coinbase
 	Signature []byte            `json:"signature"`
 }
 
+// Output is a payment made by a coinbase as well as the one to its Receiver,
+// so a block's reward can be split, for example between the members of a
+// mining pool
+type Output struct {
+	Receiver ed25519.PublicKey `json:"receiver"`
+	Value    uint64            `json:"value"`
+}
+
+// NewCoinbase creates the first transaction of the block at height, which
+// pays value (the block reward plus fees) to receiver. data is arbitrary and
+// can be changed to give the miner extra nonce space. Any outputs are paid
+// too, and count towards what the coinbase claims.
+func NewCoinbase(receiver ed25519.PublicKey, value uint64, height int, data []byte, outputs ...Output) Transaction {
+	return Transaction{
+		Receiver: receiver,
+		Value:    value,
+		Nonce:    uint64(height),
+		Data:     data,
+		Outputs:  outputs,
+	}
+}
+
 func (tx Transaction) String() string {
-	return fmt.Sprintf("{Sender:%s Receiver:%s Value:%d Signature:%s}",
+	outputs := make([]string, len(tx.Outputs))
+	for i, o := range tx.Outputs {
+		outputs[i] = fmt.Sprintf("%s:%d", hex.EncodeToString(o.Receiver), o.Value)
+	}
+
+	return fmt.Sprintf("{Sender:%s Receiver:%s Value:%d Fee:%d Nonce:%d Data:%s Outputs:%v Signature:%s}",
 		hex.EncodeToString(tx.Sender),
 		hex.EncodeToString(tx.Receiver),
 		tx.Value,
+		tx.Fee,
+		tx.Nonce,
+		hex.EncodeToString(tx.Data),
+		outputs,
 		hex.EncodeToString(tx.Signature),
 	)
 }
 
 func (tx *Transaction) Clone() Transaction {
+	var outputs []Output
+	for _, o := range tx.Outputs {
+		outputs = append(outputs, Output{Receiver: slices.Clone(o.Receiver), Value: o.Value})
+	}
+
 	return Transaction{
 		Sender:    slices.Clone(tx.Sender),
 		Receiver:  slices.Clone(tx.Receiver),
 		Value:     tx.Value,
+		Fee:       tx.Fee,
+		Nonce:     tx.Nonce,
+		Data:      slices.Clone(tx.Data),
+		Outputs:   outputs,
 		Signature: slices.Clone(tx.Signature),
 	}
 }
 
+// IsCoinbase reports whether tx has no sender, which is only valid for the
+// first transaction of a block
+func (tx *Transaction) IsCoinbase() bool {
+	return len(tx.Sender) == 0
+}
+
 func (tx *Transaction) Verify() error {
+	if len(tx.Sender) != ed25519.PublicKeySize {
+		return ErrInvalidTransaction{tx: *tx, reason: "invalid sender"}
+	}
+	if len(tx.Receiver) != ed25519.PublicKeySize {
+		return ErrInvalidTransaction{tx: *tx, reason: "invalid receiver"}
+	}
+	if len(tx.Data) != 0 {
+		return ErrInvalidTransaction{tx: *tx, reason: "only a coinbase can carry data"}
+	}
+	if len(tx.Outputs) != 0 {
+		return ErrInvalidTransaction{tx: *tx, reason: "only a coinbase can have outputs"}
+	}
+
 	hash := tx.Hash()
 	if !ed25519.Verify(tx.Sender, hash[:], tx.Signature) {
 		return ErrInvalidTransaction{tx: *tx, reason: "invalid signature"}
@@ -54,27 +123,100 @@ func (tx *Transaction) Verify() error {
 	if tx.Value == 0 {
 		return ErrInvalidTransaction{tx: *tx, reason: "value is 0"}
 	}
+	if tx.Cost() < tx.Value {
+		return ErrInvalidTransaction{tx: *tx, reason: "value plus fee overflows"}
+	}
 	return nil
 }
 
-func (tx *Transaction) Hash() [32]byte {
-	return hashTransaction(tx.Sender, tx.Receiver, tx.Value)
+// VerifyCoinbase checks tx is well formed as a coinbase. Whether it claims
+// the right amount, at the right height, depends on the chain.
+func (tx *Transaction) VerifyCoinbase() error {
+	if !tx.IsCoinbase() {
+		return ErrInvalidTransaction{tx: *tx, reason: "coinbase has a sender"}
+	}
+	if len(tx.Receiver) != ed25519.PublicKeySize {
+		return ErrInvalidTransaction{tx: *tx, reason: "invalid receiver"}
+	}
+	if tx.Fee != 0 || len(tx.Signature) != 0 {
+		return ErrInvalidTransaction{tx: *tx, reason: "coinbase has a fee or signature"}
+	}
+	if len(tx.Data) > MaxCoinbaseData {
+		return ErrInvalidTransaction{tx: *tx, reason: "coinbase data is too long"}
+	}
+	if len(tx.Outputs) > MaxCoinbaseOutputs {
+		return ErrInvalidTransaction{tx: *tx, reason: "coinbase has too many outputs"}
+	}
+	for _, o := range tx.Outputs {
+		if len(o.Receiver) != ed25519.PublicKeySize {
+			return ErrInvalidTransaction{tx: *tx, reason: "invalid output receiver"}
+		}
+		if o.Value == 0 {
+			return ErrInvalidTransaction{tx: *tx, reason: "output value is 0"}
+		}
+	}
+	if _, ok := tx.CoinbaseValue(); !ok {
+		return ErrInvalidTransaction{tx: *tx, reason: "coinbase value overflows"}
+	}
+	return nil
 }
 
-func hashTransaction(sender ed25519.PublicKey, receiver ed25519.PublicKey, value uint64) [32]byte {
-	data := []byte(sender)[:]
-	data = append(data, []byte(receiver)[:]...)
-	data = binary.LittleEndian.AppendUint64(data, uint64(value))
-	return sha256.Sum256(data)
+// CoinbaseValue is the total a coinbase pays, to its Receiver and every
+// output. ok is false if the total overflows.
+func (tx *Transaction) CoinbaseValue() (total uint64, ok bool) {
+	total = tx.Value
+	for _, o := range tx.Outputs {
+		if total+o.Value < total {
+			return 0, false
+		}
+		total += o.Value
+	}
+	return total, true
+}
+
+// Cost is the total amount debited from the sender
+func (tx *Transaction) Cost() uint64 {
+	return tx.Value + tx.Fee
+}
+
+// Size is the length of the transaction's JSON encoding
+func (tx *Transaction) Size() int {
+	return encodedSize(tx)
+}
+
+// encodedSize is the length of v's JSON encoding, which is how transactions,
+// blocks and headers are stored and sent to peers. It is only used for types
+// whose every field is always encodable.
+func encodedSize(v any) int {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return len(data)
 }
 
-func HashTransactions(txs []Transaction) [32]byte {
-	var hashData []byte
+func (tx *Transaction) Hash() [32]byte {
+	hash := hashTransaction(tx.Sender, tx.Receiver, tx.Value, tx.Fee, tx.Nonce, tx.Data)
+	if len(tx.Outputs) == 0 {
+		return hash
+	}
 
-	for _, tx := range txs {
-		hash := tx.Hash()
-		hashData = append(hashData, hash[:]...)
+	// Chained on, so transactions without outputs keep the same hash
+	data := hash[:]
+	for _, o := range tx.Outputs {
+		data = append(data, o.Receiver...)
+		data = binary.LittleEndian.AppendUint64(data, o.Value)
 	}
+	return sha256.Sum256(data)
+}
 
-	return sha256.Sum256(hashData)
+func hashTransaction(sender ed25519.PublicKey, receiver ed25519.PublicKey, value uint64, fee uint64, nonce uint64, extra []byte) [32]byte {
+	data := []byte(sender)[:]
+	data = append(data, []byte(receiver)[:]...)
+	data = binary.LittleEndian.AppendUint64(data, uint64(value))
+	data = binary.LittleEndian.AppendUint64(data, fee)
+	data = binary.LittleEndian.AppendUint64(data, nonce)
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(extra)))
+	data = append(data, extra...)
+	return sha256.Sum256(data)
 }
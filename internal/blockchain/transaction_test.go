@@ -2,14 +2,17 @@ package blockchain_test
 
 import (
 	"encoding/json"
+	"errors"
 	"testing"
+
+	"github.com/zakkbob/go-blockchain/internal/blockchain"
 )
 
 func TestMarshalTransaction(t *testing.T) {
 	addr1 := MustGenerateTestAddress(t)
 	addr2 := MustGenerateTestAddress(t)
 
-	tx := addr1.NewTransaction(addr2.PublicKey(), 8)
+	tx := addr1.NewTransaction(addr2.PublicKey(), 8, 0, 0)
 
 	js, err := json.Marshal(tx)
 	if err != nil {
@@ -18,3 +21,53 @@ func TestMarshalTransaction(t *testing.T) {
 
 	t.Log(string(js))
 }
+
+func TestTransactionVerifyMalformed(t *testing.T) {
+	addr1 := MustGenerateTestAddress(t)
+	addr2 := MustGenerateTestAddress(t)
+
+	changes := map[string]func(tx *blockchain.Transaction){
+		"short sender":   func(tx *blockchain.Transaction) { tx.Sender = tx.Sender[:5] },
+		"no sender":      func(tx *blockchain.Transaction) { tx.Sender = nil },
+		"short receiver": func(tx *blockchain.Transaction) { tx.Receiver = tx.Receiver[:5] },
+		"data":           func(tx *blockchain.Transaction) { tx.Data = []byte{1} },
+		"outputs":        func(tx *blockchain.Transaction) { tx.Outputs = []blockchain.Output{{Receiver: tx.Receiver, Value: 1}} },
+	}
+
+	for name, change := range changes {
+		tx := addr1.NewTransaction(addr2.PublicKey(), 8, 0, 0)
+		change(&tx)
+
+		var invalid blockchain.ErrInvalidTransaction
+		if err := tx.Verify(); !errors.As(err, &invalid) {
+			t.Errorf("%s: Verify should return an invalid transaction error, not %v", name, err)
+		}
+	}
+}
+
+func TestCoinbaseHash(t *testing.T) {
+	addr := MustGenerateTestAddress(t)
+
+	a := blockchain.NewCoinbase(addr.PublicKey(), 10, 1, nil)
+	b := blockchain.NewCoinbase(addr.PublicKey(), 10, 2, nil)
+	c := blockchain.NewCoinbase(addr.PublicKey(), 10, 1, []byte{1})
+
+	d := blockchain.NewCoinbase(addr.PublicKey(), 10, 1, nil, blockchain.Output{Receiver: addr.PublicKey(), Value: 1})
+	e := blockchain.NewCoinbase(addr.PublicKey(), 10, 1, nil, blockchain.Output{Receiver: addr.PublicKey(), Value: 2})
+
+	if a.Hash() == b.Hash() || a.Hash() == c.Hash() {
+		t.Error("coinbases at different heights or with different data should have different hashes")
+	}
+	if a.Hash() == d.Hash() || d.Hash() == e.Hash() {
+		t.Error("coinbases with different outputs should have different hashes")
+	}
+	if err := d.VerifyCoinbase(); err != nil {
+		t.Errorf("VerifyCoinbase should not return an error: %v", err)
+	}
+	if err := c.VerifyCoinbase(); err != nil {
+		t.Errorf("VerifyCoinbase should not return an error: %v", err)
+	}
+	if err := c.Verify(); err == nil {
+		t.Error("a coinbase should not verify as an ordinary transaction")
+	}
+}
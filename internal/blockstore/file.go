@@ -0,0 +1,302 @@
+package blockstore
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/zakkbob/go-blockchain/internal/blockchain"
+)
+
+const (
+	indexFileName  = "index"
+	indexEntrySize = 32 + 4 + 8 + 4 // hash, file number, offset, length
+
+	DefaultMaxFileSize = 64 << 20
+)
+
+var (
+	ErrCorruptIndex = errors.New("block index is corrupt")
+)
+
+type indexEntry struct {
+	hash   [32]byte
+	file   uint32
+	offset uint64
+	length uint32
+}
+
+func (e indexEntry) bytes() []byte {
+	data := make([]byte, 0, indexEntrySize)
+	data = append(data, e.hash[:]...)
+	data = binary.LittleEndian.AppendUint32(data, e.file)
+	data = binary.LittleEndian.AppendUint64(data, e.offset)
+	data = binary.LittleEndian.AppendUint32(data, e.length)
+	return data
+}
+
+func parseIndexEntry(data []byte) indexEntry {
+	var e indexEntry
+	copy(e.hash[:], data[:32])
+	e.file = binary.LittleEndian.Uint32(data[32:36])
+	e.offset = binary.LittleEndian.Uint64(data[36:44])
+	e.length = binary.LittleEndian.Uint32(data[44:48])
+	return e
+}
+
+// FileStore keeps blocks in append-only data files (blk00000.dat,
+// blk00001.dat, ...) and an index of where each block lives. Blocks are
+// written before their index entry, so after a crash anything not in the
+// index is discarded.
+type FileStore struct {
+	dir         string
+	maxFileSize int64
+
+	index   *os.File
+	entries []indexEntry
+
+	data     *os.File // Data file currently being appended to
+	dataNum  uint32
+	dataSize int64
+
+	mu sync.Mutex
+}
+
+// Open opens, or creates, the block store in dir
+func Open(dir string) (*FileStore, error) {
+	return OpenWithMaxFileSize(dir, DefaultMaxFileSize)
+}
+
+// OpenWithMaxFileSize is Open, but starts a new data file once the current
+// one reaches maxFileSize bytes
+func OpenWithMaxFileSize(dir string, maxFileSize int64) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating block store directory: %w", err)
+	}
+
+	s := &FileStore{
+		dir:         dir,
+		maxFileSize: maxFileSize,
+	}
+
+	if err := s.openIndex(); err != nil {
+		return nil, err
+	}
+
+	if err := s.openData(); err != nil {
+		s.index.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *FileStore) dataPath(n uint32) string {
+	return filepath.Join(s.dir, fmt.Sprintf("blk%05d.dat", n))
+}
+
+func (s *FileStore) openIndex() error {
+	var err error
+	s.index, err = os.OpenFile(filepath.Join(s.dir, indexFileName), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening block index: %w", err)
+	}
+
+	raw, err := io.ReadAll(s.index)
+	if err != nil {
+		s.index.Close()
+		return fmt.Errorf("reading block index: %w", err)
+	}
+
+	// A partially written entry is the result of a crash, drop it
+	complete := len(raw) - len(raw)%indexEntrySize
+	if err := s.index.Truncate(int64(complete)); err != nil {
+		s.index.Close()
+		return fmt.Errorf("truncating block index: %w", err)
+	}
+	if _, err := s.index.Seek(int64(complete), io.SeekStart); err != nil {
+		s.index.Close()
+		return fmt.Errorf("seeking block index: %w", err)
+	}
+
+	for i := 0; i < complete; i += indexEntrySize {
+		e := parseIndexEntry(raw[i : i+indexEntrySize])
+		if n := len(s.entries); n > 0 && e.file < s.entries[n-1].file {
+			s.index.Close()
+			return ErrCorruptIndex
+		}
+		s.entries = append(s.entries, e)
+	}
+
+	return nil
+}
+
+// openData opens the last data file for appending, discarding anything after
+// the last indexed block
+func (s *FileStore) openData() error {
+	var end int64
+	if n := len(s.entries); n > 0 {
+		last := s.entries[n-1]
+		s.dataNum = last.file
+		end = int64(last.offset) + int64(last.length)
+	}
+
+	var err error
+	s.data, err = os.OpenFile(s.dataPath(s.dataNum), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening block data file: %w", err)
+	}
+
+	info, err := s.data.Stat()
+	if err != nil {
+		s.data.Close()
+		return fmt.Errorf("reading block data file: %w", err)
+	}
+	if info.Size() < end {
+		s.data.Close()
+		return ErrCorruptIndex
+	}
+
+	if err := s.data.Truncate(end); err != nil {
+		s.data.Close()
+		return fmt.Errorf("truncating block data file: %w", err)
+	}
+	if _, err := s.data.Seek(end, io.SeekStart); err != nil {
+		s.data.Close()
+		return fmt.Errorf("seeking block data file: %w", err)
+	}
+	s.dataSize = end
+
+	return nil
+}
+
+func (s *FileStore) Put(b *blockchain.Block) error {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return fmt.Errorf("encoding block: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.dataSize > 0 && s.dataSize+int64(len(data)) > s.maxFileSize {
+		if err := s.nextDataFile(); err != nil {
+			return err
+		}
+	}
+
+	e := indexEntry{
+		hash:   b.Hash(),
+		file:   s.dataNum,
+		offset: uint64(s.dataSize),
+		length: uint32(len(data)),
+	}
+
+	if _, err := s.data.Write(data); err != nil {
+		return errors.Join(fmt.Errorf("writing block: %w", err), s.rollback())
+	}
+	if err := s.data.Sync(); err != nil {
+		return errors.Join(fmt.Errorf("syncing block data file: %w", err), s.rollback())
+	}
+
+	if _, err := s.index.Write(e.bytes()); err != nil {
+		return errors.Join(fmt.Errorf("writing block index: %w", err), s.rollback())
+	}
+	if err := s.index.Sync(); err != nil {
+		return errors.Join(fmt.Errorf("syncing block index: %w", err), s.rollback())
+	}
+	s.dataSize += int64(len(data))
+	s.entries = append(s.entries, e)
+
+	return nil
+}
+
+// rollback discards whatever a failed Put managed to write, so both files end
+// where the last indexed block does. Otherwise the next block would be indexed
+// at the wrong offset.
+func (s *FileStore) rollback() error {
+	indexSize := int64(len(s.entries)) * indexEntrySize
+
+	if err := s.data.Truncate(s.dataSize); err != nil {
+		return fmt.Errorf("truncating block data file: %w", err)
+	}
+	if _, err := s.data.Seek(s.dataSize, io.SeekStart); err != nil {
+		return fmt.Errorf("seeking block data file: %w", err)
+	}
+	if err := s.index.Truncate(indexSize); err != nil {
+		return fmt.Errorf("truncating block index: %w", err)
+	}
+	if _, err := s.index.Seek(indexSize, io.SeekStart); err != nil {
+		return fmt.Errorf("seeking block index: %w", err)
+	}
+	return nil
+}
+
+func (s *FileStore) nextDataFile() error {
+	if err := s.data.Close(); err != nil {
+		return fmt.Errorf("closing block data file: %w", err)
+	}
+
+	f, err := os.OpenFile(s.dataPath(s.dataNum+1), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("creating block data file: %w", err)
+	}
+
+	s.data = f
+	s.dataNum++
+	s.dataSize = 0
+	return nil
+}
+
+func (s *FileStore) Blocks() ([]blockchain.Block, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	blocks := make([]blockchain.Block, 0, len(s.entries))
+	files := map[uint32]*os.File{}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for _, e := range s.entries {
+		f, ok := files[e.file]
+		if !ok {
+			var err error
+			f, err = os.Open(s.dataPath(e.file))
+			if err != nil {
+				return nil, fmt.Errorf("opening block data file: %w", err)
+			}
+			files[e.file] = f
+		}
+
+		data := make([]byte, e.length)
+		if _, err := f.ReadAt(data, int64(e.offset)); err != nil {
+			return nil, fmt.Errorf("reading block: %w", err)
+		}
+
+		var b blockchain.Block
+		if err := json.Unmarshal(data, &b); err != nil {
+			return nil, fmt.Errorf("decoding block: %w", err)
+		}
+		if b.Hash() != e.hash {
+			return nil, ErrCorruptIndex
+		}
+
+		blocks = append(blocks, b)
+	}
+
+	return blocks, nil
+}
+
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return errors.Join(s.data.Close(), s.index.Close())
+}
@@ -0,0 +1,45 @@
+package blockstore
+
+import (
+	"testing"
+
+	"github.com/zakkbob/go-blockchain/internal/blockchain"
+)
+
+func TestFileStoreRollback(t *testing.T) {
+	dir := t.TempDir()
+	miner := blockchain.MustGenerateTestAddress(t)
+
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := blockchain.NewLedger(blockchain.NewTestParams(), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A Put which fails part way through its data and index writes
+	s.data.Write([]byte(`{"version":1,"diffi`))
+	s.index.Write(make([]byte, indexEntrySize/2))
+	if err := s.rollback(); err != nil {
+		t.Fatalf("rollback should not return an error: %v", err)
+	}
+
+	blockchain.MustAddNewTestBlock(t, l, []blockchain.Transaction{}, miner.PublicKey())
+	s.Close()
+
+	s, err = Open(dir)
+	if err != nil {
+		t.Fatalf("Open should not return an error: %v", err)
+	}
+	defer s.Close()
+
+	blocks, err := s.Blocks()
+	if err != nil {
+		t.Fatalf("Blocks should not return an error: %v", err)
+	}
+	if len(blocks) != 2 || blocks[1].Hash() != l.HeadHash() {
+		t.Errorf("blocks after a failed put should be stored intact, got %d", len(blocks))
+	}
+}
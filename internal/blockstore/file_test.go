@@ -0,0 +1,151 @@
+package blockstore_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zakkbob/go-blockchain/internal/blockchain"
+	"github.com/zakkbob/go-blockchain/internal/blockstore"
+)
+
+func mustOpen(t *testing.T, dir string, maxFileSize int64) *blockstore.FileStore {
+	t.Helper()
+	s, err := blockstore.OpenWithMaxFileSize(dir, maxFileSize)
+	if err != nil {
+		t.Fatalf("Open should not return an error: %v", err)
+	}
+	return s
+}
+
+func mustCreateChain(t *testing.T, s blockchain.Store, length int) *blockchain.Ledger {
+	t.Helper()
+	miner := blockchain.MustGenerateTestAddress(t)
+
+	l, err := blockchain.NewLedger(blockchain.NewTestParams(), s)
+	if err != nil {
+		t.Fatalf("NewLedger should not return an error: %v", err)
+	}
+
+	for range length - 1 {
+		blockchain.MustAddNewTestBlock(t, l, []blockchain.Transaction{}, miner.PublicKey())
+	}
+
+	return l
+}
+
+func assertStoredChain(t *testing.T, s blockchain.Store, l *blockchain.Ledger) {
+	t.Helper()
+	blocks, err := s.Blocks()
+	if err != nil {
+		t.Fatalf("Blocks should not return an error: %v", err)
+	}
+
+	if len(blocks) != l.Length() {
+		t.Fatalf("expected %d stored blocks; got %d", l.Length(), len(blocks))
+	}
+	if blocks[len(blocks)-1].Hash() != l.HeadHash() {
+		t.Errorf("last stored block should be the head")
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+
+	// Small enough that blocks are spread over several files
+	s := mustOpen(t, dir, 1024)
+	l := mustCreateChain(t, s, 10)
+	assertStoredChain(t, s, l)
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "blk*.dat"))
+	if len(files) < 2 {
+		t.Errorf("blocks should be split between data files, got %d files", len(files))
+	}
+
+	s = mustOpen(t, dir, 1024)
+	defer s.Close()
+	assertStoredChain(t, s, l)
+}
+
+func TestFileStoreRecovery(t *testing.T) {
+	dir := t.TempDir()
+
+	s := mustOpen(t, dir, blockstore.DefaultMaxFileSize)
+	l := mustCreateChain(t, s, 3)
+	s.Close()
+
+	// Simulate a crash part way through writing a block and its index entry
+	for _, name := range []string{"blk00000.dat", "index"} {
+		f, err := os.OpenFile(filepath.Join(dir, name), os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(`{"version":1,"diffi`))
+		f.Close()
+	}
+
+	s = mustOpen(t, dir, blockstore.DefaultMaxFileSize)
+	defer s.Close()
+	assertStoredChain(t, s, l)
+
+	l, err := blockchain.NewLedger(blockchain.NewTestParams(), s)
+	if err != nil {
+		t.Fatalf("NewLedger should not return an error: %v", err)
+	}
+	miner := blockchain.MustGenerateTestAddress(t)
+	blockchain.MustAddNewTestBlock(t, l, []blockchain.Transaction{}, miner.PublicKey())
+	assertStoredChain(t, s, l)
+}
+
+func TestLedgerReload(t *testing.T) {
+	dir := t.TempDir()
+	miner := blockchain.MustGenerateTestAddress(t)
+	receiver := blockchain.MustGenerateTestAddress(t)
+
+	s := mustOpen(t, dir, blockstore.DefaultMaxFileSize)
+	l := mustCreateChain(t, s, 1)
+	blockchain.MustAddNewTestBlock(t, l, []blockchain.Transaction{}, miner.PublicKey())
+	blockchain.MustAddNewTestBlock(t, l, []blockchain.Transaction{miner.NewTransaction(receiver.PublicKey(), 4, 1, 0)}, miner.PublicKey())
+	s.Close()
+
+	s = mustOpen(t, dir, blockstore.DefaultMaxFileSize)
+	defer s.Close()
+
+	reloaded, err := blockchain.NewLedger(blockchain.NewTestParams(), s)
+	if err != nil {
+		t.Fatalf("NewLedger should not return an error: %v", err)
+	}
+
+	if reloaded.HeadHash() != l.HeadHash() {
+		t.Error("reloaded ledger should have the same head")
+	}
+	if reloaded.Length() != 3 {
+		t.Errorf("expected length of 3; got %d", reloaded.Length())
+	}
+	blockchain.AssertAddressBalance(t, reloaded, miner, 16)
+	blockchain.AssertAddressBalance(t, reloaded, receiver, 4)
+
+	// Nothing should have been stored twice
+	assertStoredChain(t, s, reloaded)
+}
+
+func TestLedgerReloadGenesisMismatch(t *testing.T) {
+	dir := t.TempDir()
+
+	s := mustOpen(t, dir, blockstore.DefaultMaxFileSize)
+	mustCreateChain(t, s, 2)
+	s.Close()
+
+	s = mustOpen(t, dir, blockstore.DefaultMaxFileSize)
+	defer s.Close()
+
+	params, _ := blockchain.NetworkParams("testnet")
+	if _, err := blockchain.NewLedger(params, s); !errors.Is(err, blockchain.ErrGenesisMismatch) {
+		t.Errorf("NewLedger should return %v, not %v", blockchain.ErrGenesisMismatch, err)
+	}
+}
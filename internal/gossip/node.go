@@ -1,13 +1,26 @@
 package gossip
 
 import (
-	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"io"
 	"log/slog"
+	"maps"
 	"net"
+	"slices"
+	"sync"
+)
+
+// DefaultMaxMessageSize is the largest message accepted from a peer when a
+// Node doesn't set its own limit
+const DefaultMaxMessageSize = 4 << 20
+
+var (
+	ErrUnknownPeer     = errors.New("not connected to peer")
+	ErrNodeClosed      = errors.New("node has been closed")
+	ErrMessageTooLarge = errors.New("message is larger than the maximum message size")
 )
 
 type ReceivedMessage struct {
@@ -29,15 +42,77 @@ type Message struct {
 	Data any    `json:"data"`
 }
 
+// Node gossips messages with every peer it is connected to. Each connection
+// is a Peer, so requests can also be made of a particular peer.
 type Node struct {
-	Addr     string
-	Logger   *slog.Logger
-	handler  func(ReceivedMessage)
-	listener net.Listener
-	conns    []net.Conn
+	Addr           string
+	Logger         *slog.Logger
+	Handshake      *Message                           // Sent to every peer as soon as a connection is made
+	MaxMessageSize int                                // Peers sending a longer message (in bytes) are dropped, 0 uses DefaultMaxMessageSize
+	RequestHandler func(ReceivedRequest) (any, error) // Answers requests from peers, may be nil
+	OnDisconnect   func(remoteAddr string)            // Called once a peer's connection has closed and it is forgotten, may be nil
+	handler        func(ReceivedMessage)
+	listener       net.Listener
+	ready          chan struct{}    // Closed once listener is set
+	peers          map[string]*Peer // indexed by remote address
+	closed         bool             // Set by Close, after which no more peers are added
+	handlers       sync.WaitGroup   // Peers still being handled
+	mu             sync.Mutex
+}
+
+// messageLimiter stops a decoder reading more than limit bytes in total. The
+// decoder reads ahead, so the limit is moved along as each message is decoded
+// rather than counting the bytes of each read.
+type messageLimiter struct {
+	r     io.Reader
+	read  int64
+	limit int64
+}
+
+func (l *messageLimiter) Read(p []byte) (int, error) {
+	if l.read >= l.limit {
+		return 0, ErrMessageTooLarge
+	}
+	if remaining := l.limit - l.read; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	return n, err
+}
+
+func (n *Node) maxMessageSize() int64 {
+	if n.MaxMessageSize > 0 {
+		return int64(n.MaxMessageSize)
+	}
+	return DefaultMaxMessageSize
+}
+
+// Ready is closed once the node is connected to its bootstrap peers and
+// listening, after which ListenerAddr can be used
+func (n *Node) Ready() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.readyChan()
+}
+
+// readyChan must be called with mu held
+func (n *Node) readyChan() chan struct{} {
+	if n.ready == nil {
+		n.ready = make(chan struct{})
+	}
+	return n.ready
 }
 
+// ListenerAddr returns the address the node is listening on, or nil if it
+// isn't listening yet
 func (n *Node) ListenerAddr() net.Addr {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.listener == nil {
+		return nil
+	}
 	return n.listener.Addr()
 }
 
@@ -52,7 +127,7 @@ func (n *Node) connectTo(peers []string) error {
 			continue
 		}
 
-		go n.handle(conn)
+		n.serve(conn)
 	}
 
 	if len(errs) > 0 {
@@ -62,73 +137,195 @@ func (n *Node) connectTo(peers []string) error {
 	return nil
 }
 
+// Broadcast sends a message to every peer. The peers are written to without
+// the node locked, so one which has stopped reading only holds up the
+// broadcast until its write times out.
 func (n *Node) Broadcast(m Message) error {
-	b, err := json.Marshal(m)
+	b, err := encodeUpdate(m.Type, m.Data)
 	if err != nil {
 		return err
 	}
 
-	for _, c := range n.conns {
-		_, err = c.Write(b)
+	n.mu.Lock()
+	peers := slices.Collect(maps.Values(n.peers))
+	n.mu.Unlock()
+
+	var errs []error
+	for _, p := range peers {
+		if err := p.sendEncodedUpdate(b); err != nil {
+			errs = append(errs, err)
+		}
 	}
-	if err != nil {
-		return err
+
+	return errors.Join(errs...)
+}
+
+// Send sends a message to the peer at remoteAddr only
+func (n *Node) Send(remoteAddr string, m Message) error {
+	p, ok := n.peer(remoteAddr)
+	if !ok {
+		return ErrUnknownPeer
 	}
 
-	return nil
+	return p.Update(m.Type, m.Data)
+}
+
+// Request makes a request of the peer at remoteAddr and waits for its response
+func (n *Node) Request(ctx context.Context, remoteAddr string, requestType string, data any) (ReceivedResponse, error) {
+	p, ok := n.peer(remoteAddr)
+	if !ok {
+		return ReceivedResponse{}, ErrUnknownPeer
+	}
+
+	return p.Request(ctx, requestType, data)
+}
+
+// Disconnect closes the connection to the peer at remoteAddr
+func (n *Node) Disconnect(remoteAddr string) error {
+	p, ok := n.peer(remoteAddr)
+	if !ok {
+		return ErrUnknownPeer
+	}
+
+	return p.Disconnect()
+}
+
+func (n *Node) peer(remoteAddr string) (*Peer, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	p, ok := n.peers[remoteAddr]
+	return p, ok
+}
+
+// addPeer reports whether p was added, which it isn't once the node is
+// closed
+func (n *Node) addPeer(p *Peer) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return false
+	}
+	if n.peers == nil {
+		n.peers = map[string]*Peer{}
+	}
+	n.peers[p.RemoteAddr()] = p
+	n.handlers.Add(1)
+	return true
+}
+
+func (n *Node) removePeer(p *Peer) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.peers, p.RemoteAddr())
 }
 
+// BootstrapAndListen connects to knownPeers, then accepts connections until
+// the node is closed, when it returns ErrNodeClosed
 func (n *Node) BootstrapAndListen(knownPeers []string, handler func(ReceivedMessage)) error {
 	n.handler = handler
 
 	n.connectTo(knownPeers)
 
-	var err error
-
-	n.listener, err = net.Listen("tcp", n.Addr)
+	listener, err := net.Listen("tcp", n.Addr)
 	if err != nil {
 		return err
 	}
 
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		listener.Close()
+		return ErrNodeClosed
+	}
+	n.listener = listener
+	close(n.readyChan())
+	n.mu.Unlock()
+
 	for {
-		c, err := n.listener.Accept()
-		if err != nil {
+		c, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return ErrNodeClosed
+		} else if err != nil {
 			n.Logger.Error("Failed to accept incoming connection", "error", err)
 			continue
 		} else {
 			n.Logger.Info("Accepted incoming connection", "address", n.Addr)
 		}
 
-		go n.handle(c)
+		n.serve(c)
 	}
 }
 
-func (n *Node) handle(c net.Conn) {
-	n.conns = append(n.conns, c)
+// Close stops the node listening, disconnects every peer and waits until
+// their messages have been handled. Nothing is handled once it returns.
+func (n *Node) Close() error {
+	n.mu.Lock()
+	n.closed = true
+	var err error
+	if n.listener != nil {
+		err = n.listener.Close()
+	}
+	peers := slices.Collect(maps.Values(n.peers))
+	n.mu.Unlock()
 
-	raw := &bytes.Buffer{}
-	d := json.NewDecoder(io.TeeReader(c, raw))
+	for _, p := range peers {
+		p.Disconnect()
+	}
+	n.handlers.Wait()
 
-	for {
-		m := struct {
-			Type string          `json:"message_type"`
-			Data json.RawMessage `json:"data"`
-		}{}
+	return err
+}
 
-		err := d.Decode(&m)
-		if errors.Is(err, io.EOF) {
-			return
-		} else if err != nil {
-			n.Logger.Error("Failed to decode received message", "message", raw.String(), "peer", c.RemoteAddr().String(), "error", err)
-			continue
+// serve handles c in the background, unless the node has been closed
+func (n *Node) serve(c net.Conn) {
+	p, ok := n.connect(c)
+	if !ok {
+		c.Close()
+		return
+	}
+
+	go n.handle(p)
+}
+
+// connect adds a peer for c, which can be sent to straight away but doesn't
+// receive anything until handled. Once the node is closed, no peer is added.
+func (n *Node) connect(c net.Conn) (*Peer, bool) {
+	remoteAddr := c.RemoteAddr().String()
+
+	p := newPeer(c, n.maxMessageSize(), func(u ReceivedUpdate) error {
+		n.handler(ReceivedMessage{
+			Type:       u.Type,
+			Data:       u.Data,
+			RemoteAddr: remoteAddr,
+		})
+		return nil
+	}, n.RequestHandler)
+
+	return p, n.addPeer(p)
+}
+
+// handle sends the handshake and reads from p until the connection closes
+func (n *Node) handle(p *Peer) {
+	remoteAddr := p.RemoteAddr()
+	defer func() {
+		n.removePeer(p)
+		if n.OnDisconnect != nil {
+			n.OnDisconnect(remoteAddr)
 		}
+		n.handlers.Done()
+	}()
 
-		r := ReceivedMessage{
-			Type:       m.Type,
-			Data:       m.Data,
-			RemoteAddr: c.RemoteAddr().String(),
+	if n.Handshake != nil {
+		if err := p.Update(n.Handshake.Type, n.Handshake.Data); err != nil {
+			n.Logger.Error("Failed to send handshake", "peer", remoteAddr, "error", err)
+			p.Disconnect()
+			return
 		}
+	}
+
+	p.handle()
 
-		n.handler(r)
+	if err := p.Err(); !errors.Is(err, ErrPeerClosed) && !errors.Is(err, ErrDisconnected) {
+		n.Logger.Error("Connection to peer failed", "peer", remoteAddr, "error", err)
 	}
 }
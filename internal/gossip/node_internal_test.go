@@ -0,0 +1,42 @@
+package gossip
+
+import (
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBroadcastStalledPeer(t *testing.T) {
+	n := &Node{Logger: slog.New(slog.DiscardHandler)}
+
+	// Nothing reads from the other end, so writes never finish
+	conn1, _ := net.Pipe()
+	stalled := newPeer(conn1, DefaultMaxMessageSize, nil, nil)
+	stalled.writeTimeout = 100 * time.Millisecond
+	n.addPeer(stalled)
+
+	done := make(chan error, 1)
+	go func() { done <- n.Broadcast(Message{Type: "type", Data: "data"}) }()
+
+	// The node can still be used while the write is stuck
+	lookup := make(chan struct{})
+	go func() {
+		n.peer(stalled.RemoteAddr())
+		close(lookup)
+	}()
+	select {
+	case <-lookup:
+	case <-time.After(50 * time.Millisecond):
+		t.Fatal("node should not be locked while broadcasting")
+	}
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Broadcast should return an error for the stalled peer")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Broadcast should give up on the stalled peer")
+	}
+}
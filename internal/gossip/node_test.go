@@ -1,8 +1,12 @@
 package gossip_test
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"log/slog"
-	"net"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -10,43 +14,304 @@ import (
 )
 
 type testHandler struct {
-	message gossip.ReceivedMessage
+	messages chan gossip.ReceivedMessage
 }
 
 func (t *testHandler) handle(message gossip.ReceivedMessage) {
-	t.message = message
+	t.messages <- message
+}
+
+// startTestNode starts n listening, and waits until it is
+func startTestNode(t *testing.T, n *gossip.Node, handler func(gossip.ReceivedMessage)) {
+	t.Helper()
+
+	go func() {
+		err := n.BootstrapAndListen([]string{}, handler)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	select {
+	case <-n.Ready():
+	case <-time.After(time.Second):
+		t.Fatal("node should start listening")
+	}
+}
+
+// dialTestNode connects to n, sending every update received to the returned
+// channel
+func dialTestNode(t *testing.T, n *gossip.Node) (*gossip.Peer, chan gossip.ReceivedUpdate) {
+	t.Helper()
+
+	updates := make(chan gossip.ReceivedUpdate, 10)
+	p, err := gossip.Dial(n.ListenerAddr().String(), func(u gossip.ReceivedUpdate) error {
+		updates <- u
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Disconnect() })
+
+	return p, updates
+}
+
+func receiveUpdate(t *testing.T, updates chan gossip.ReceivedUpdate) gossip.ReceivedUpdate {
+	t.Helper()
+	select {
+	case u := <-updates:
+		return u
+	case <-time.After(time.Second):
+		t.Fatal("update should be received")
+		return gossip.ReceivedUpdate{}
+	}
 }
 
 func TestBootstrap(t *testing.T) {
-	handler := testHandler{}
+	handler := testHandler{messages: make(chan gossip.ReceivedMessage, 1)}
 
 	n := gossip.Node{
 		Addr:   ":0",
 		Logger: slog.New(slog.DiscardHandler),
 	}
+	startTestNode(t, &n, handler.handle)
+	t.Log(n.ListenerAddr())
 
-	go func() {
-		err := n.BootstrapAndListen([]string{}, handler.handle)
+	p, _ := dialTestNode(t, &n)
+	p.Update("steve", "")
+
+	select {
+	case m := <-handler.messages:
+		if m.Type != "steve" {
+			t.Errorf("I need steve")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message should be received")
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	handler := testHandler{messages: make(chan gossip.ReceivedMessage, 1)}
+
+	n := gossip.Node{
+		Addr:   ":0",
+		Logger: slog.New(slog.DiscardHandler),
+		Handshake: &gossip.Message{
+			Type: "hello",
+			Data: "steve",
+		},
+	}
+	startTestNode(t, &n, handler.handle)
+
+	p, updates := dialTestNode(t, &n)
+
+	u := receiveUpdate(t, updates)
+	if u.Type != "hello" || string(u.Data) != `"steve"` {
+		t.Errorf("expected handshake, got %v", u)
+	}
+
+	// The node knows the peer by the address it connected from
+	remoteAddr := p.LocalAddr()
+
+	if err := n.Send(remoteAddr, gossip.Message{Type: "direct", Data: "steve"}); err != nil {
+		t.Fatalf("Send should not return an error: %v", err)
+	}
+	if u := receiveUpdate(t, updates); u.Type != "direct" {
+		t.Errorf("expected direct message, got %v", u)
+	}
+
+	if err := n.Disconnect(remoteAddr); err != nil {
+		t.Fatalf("Disconnect should not return an error: %v", err)
+	}
+
+	select {
+	case <-p.Done():
+	case <-time.After(time.Second):
+		t.Fatal("connection should be closed")
+	}
+	if !errors.Is(p.Err(), gossip.ErrPeerClosed) {
+		t.Errorf("connection should be closed by the node, got %v", p.Err())
+	}
+
+	// The node forgets the peer once its side of the connection has closed
+	deadline := time.Now().Add(time.Second)
+	for !errors.Is(n.Send(remoteAddr, gossip.Message{}), gossip.ErrUnknownPeer) {
+		if time.Now().After(deadline) {
+			t.Fatal("node should forget the disconnected peer")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := n.Disconnect(remoteAddr); !errors.Is(err, gossip.ErrUnknownPeer) {
+		t.Errorf("Disconnect should return %v, not %v", gossip.ErrUnknownPeer, err)
+	}
+}
+
+func TestNodeOnDisconnect(t *testing.T) {
+	disconnected := make(chan string, 1)
+
+	n := gossip.Node{
+		Addr:         ":0",
+		Logger:       slog.New(slog.DiscardHandler),
+		OnDisconnect: func(remoteAddr string) { disconnected <- remoteAddr },
+	}
+	startTestNode(t, &n, func(gossip.ReceivedMessage) {})
+
+	p, _ := dialTestNode(t, &n)
+	p.Disconnect()
+
+	select {
+	case remoteAddr := <-disconnected:
+		if remoteAddr != p.LocalAddr() {
+			t.Errorf("expected %s to be disconnected; got %s", p.LocalAddr(), remoteAddr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnDisconnect should be called")
+	}
+
+	// The peer is forgotten by the time it is called
+	if err := n.Send(p.LocalAddr(), gossip.Message{}); !errors.Is(err, gossip.ErrUnknownPeer) {
+		t.Errorf("Send should return %v, not %v", gossip.ErrUnknownPeer, err)
+	}
+}
+
+func TestNodeClose(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var handled atomic.Bool
+
+	n := gossip.Node{
+		Addr:   ":0",
+		Logger: slog.New(slog.DiscardHandler),
+		RequestHandler: func(r gossip.ReceivedRequest) (any, error) {
+			close(started)
+			<-release
+			handled.Store(true)
+			return nil, nil
+		},
+	}
+
+	listening := make(chan error, 1)
+	go func() { listening <- n.BootstrapAndListen([]string{}, func(gossip.ReceivedMessage) {}) }()
+	<-n.Ready()
+
+	p, _ := dialTestNode(t, &n)
+	go p.Request(context.Background(), "slow", nil)
+	<-started
+
+	closed := make(chan error, 1)
+	go func() { closed <- n.Close() }()
+
+	select {
+	case <-closed:
+		t.Fatal("Close should wait for requests being handled")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case err := <-closed:
 		if err != nil {
-			t.Fatal(err)
+			t.Errorf("Close should not return an error: %v", err)
 		}
-	}()
+	case <-time.After(time.Second):
+		t.Fatal("Close should return once requests are handled")
+	}
+	if !handled.Load() {
+		t.Error("request should be handled before Close returns")
+	}
 
-	time.Sleep(time.Millisecond)
-	t.Log(n.ListenerAddr())
+	select {
+	case err := <-listening:
+		if !errors.Is(err, gossip.ErrNodeClosed) {
+			t.Errorf("BootstrapAndListen should return %v, not %v", gossip.ErrNodeClosed, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("BootstrapAndListen should return once closed")
+	}
 
-	conn, err := net.Dial("tcp", n.ListenerAddr().String())
+	select {
+	case <-p.Done():
+	case <-time.After(time.Second):
+		t.Error("peers should be disconnected")
+	}
+}
+
+func TestNodeRequest(t *testing.T) {
+	n := gossip.Node{
+		Addr:   ":0",
+		Logger: slog.New(slog.DiscardHandler),
+		RequestHandler: func(r gossip.ReceivedRequest) (any, error) {
+			if r.Type != "echo" {
+				return nil, errors.New("unknown request")
+			}
+			return r.Data, nil
+		},
+	}
+	startTestNode(t, &n, func(gossip.ReceivedMessage) {})
+
+	p, _ := dialTestNode(t, &n)
+
+	res, err := p.Request(context.Background(), "echo", "steve")
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("Request should not return an error: %v", err)
+	}
+	if string(res.Data) != `"steve"` {
+		t.Errorf("expected echo, got %s", res.Data)
+	}
+
+	if _, err := p.Request(context.Background(), "other", nil); !errors.Is(err, gossip.ErrRequestFailed) {
+		t.Errorf("Request should return %v, not %v", gossip.ErrRequestFailed, err)
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	received := make(chan gossip.ReceivedMessage, 10)
+
+	n := gossip.Node{
+		Addr:           ":0",
+		Logger:         slog.New(slog.DiscardHandler),
+		MaxMessageSize: 150,
 	}
+	startTestNode(t, &n, func(m gossip.ReceivedMessage) { received <- m })
+
+	p, _ := dialTestNode(t, &n)
 
-	conn.Write([]byte(`{"message_type":"steve","data":""}`))
+	// Several small messages add up to more than the limit, but each is fine
+	for range 3 {
+		p.Update("small", strings.Repeat("a", 50))
+	}
+	for range 3 {
+		select {
+		case m := <-received:
+			if m.Type != "small" {
+				t.Errorf("expected small message, got %s", m.Type)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("small messages should be received")
+		}
+	}
 
-	time.Sleep(time.Millisecond)
+	p.Update("large", strings.Repeat("a", 200))
 
-	if handler.message.Type != "steve" {
-		t.Errorf("I need steve")
+	select {
+	case <-p.Done():
+	case <-time.After(time.Second):
+		t.Fatal("peer sending a large message should be disconnected")
 	}
 
-	conn.Close()
+	select {
+	case m := <-received:
+		t.Errorf("large message should not be handled, got %s", m.Type)
+	default:
+	}
+}
+
+func TestMarshalMessage(t *testing.T) {
+	b, err := json.Marshal(gossip.Message{Type: "steve", Data: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(string(b))
 }
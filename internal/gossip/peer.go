@@ -1,7 +1,6 @@
 package gossip
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -10,6 +9,7 @@ import (
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type messageType int
@@ -20,6 +20,13 @@ const (
 	response
 )
 
+var (
+	ErrDisconnected       = errors.New("peer has been disconnected")
+	ErrPeerClosed         = errors.New("peer closed the connection")
+	ErrRequestFailed      = errors.New("peer failed to handle request")
+	ErrRequestsNotHandled = errors.New("requests are not handled")
+)
+
 type message struct {
 	MessageType messageType `json:"message_type"`
 	Message     any         `json:"message"`
@@ -46,32 +53,55 @@ type Request struct {
 }
 
 type ReceivedRequest struct {
-	ID   int             `json:"id"`
-	Type string          `json:"request_type"`
-	Data json.RawMessage `json:"data"`
+	ID         int             `json:"id"`
+	Type       string          `json:"request_type"`
+	Data       json.RawMessage `json:"data"`
+	RemoteAddr string          `json:"-"`
 }
 
 type Response struct {
-	RequestID int `json:"request_id"`
-	Data      any `json:"data"`
+	RequestID int    `json:"request_id"`
+	Data      any    `json:"data"`
+	Error     string `json:"error,omitempty"` // Set instead of Data if the request couldn't be handled
 }
 
 type ReceivedResponse struct {
 	RequestID int             `json:"request_id"`
 	Data      json.RawMessage `json:"data"`
+	Error     string          `json:"error,omitempty"`
 }
 
+// MaxConcurrentRequests is how many requests from one peer are handled at
+// once. Any more wait, and stop the peer's messages being read until one
+// finishes, so a peer can't make us do unbounded work in parallel.
+const MaxConcurrentRequests = 4
+
+// DefaultWriteTimeout is how long sending a message to a peer may take before
+// it is assumed to have stopped reading, and is disconnected
+const DefaultWriteTimeout = 10 * time.Second
+
+// Peer is a connection over which updates can be sent, and requests made and
+// answered. Updates are handled in the order they arrive, requests are
+// handled concurrently (up to MaxConcurrentRequests) so a slow one doesn't
+// hold up the connection.
 type Peer struct {
-	conn   net.Conn
-	lastID atomic.Int64
+	conn           net.Conn
+	lastID         atomic.Int64
+	maxMessageSize int64
+	writeTimeout   time.Duration
 
 	updateHandler  func(ReceivedUpdate) error
 	requestHandler func(ReceivedRequest) (response any, err error)
 
 	responseMap map[int]chan ReceivedResponse
-	mu          sync.RWMutex
-
-	closeErr error // isnt handled properlu yet
+	requests    chan struct{}  // Holds a token for each request being handled
+	handlers    sync.WaitGroup // Requests still being handled
+	mu          sync.Mutex
+	writeMu     sync.Mutex
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	closeErr  error // Why the connection was closed, set before closed is
 }
 
 func Dial(address string, updateHandler func(ReceivedUpdate) error, requestHandler func(ReceivedRequest) (any, error)) (*Peer, error) {
@@ -84,24 +114,63 @@ func Dial(address string, updateHandler func(ReceivedUpdate) error, requestHandl
 }
 
 func peerFromConn(conn net.Conn, updateHandler func(ReceivedUpdate) error, requestHandler func(ReceivedRequest) (any, error)) (*Peer, error) {
-	p := &Peer{
+	p := newPeer(conn, DefaultMaxMessageSize, updateHandler, requestHandler)
+
+	go p.handle()
+
+	return p, nil
+}
+
+// newPeer wraps conn without reading from it, handle must be called to start
+// receiving messages
+func newPeer(conn net.Conn, maxMessageSize int64, updateHandler func(ReceivedUpdate) error, requestHandler func(ReceivedRequest) (any, error)) *Peer {
+	return &Peer{
 		conn:           conn,
+		maxMessageSize: maxMessageSize,
+		writeTimeout:   DefaultWriteTimeout,
 		updateHandler:  updateHandler,
 		requestHandler: requestHandler,
 		responseMap:    map[int]chan ReceivedResponse{},
+		requests:       make(chan struct{}, MaxConcurrentRequests),
+		closed:         make(chan struct{}),
 	}
+}
 
-	go p.handle()
+func (p *Peer) RemoteAddr() string {
+	return p.conn.RemoteAddr().String()
+}
 
-	return p, nil
+func (p *Peer) LocalAddr() string {
+	return p.conn.LocalAddr().String()
 }
 
-func (p *Peer) Update(updateType string, data any) error {
-	if p.closeErr != nil {
+// Done is closed once the connection to the peer is closed
+func (p *Peer) Done() <-chan struct{} {
+	return p.closed
+}
+
+// Err returns why the connection was closed, or nil if it is still open
+func (p *Peer) Err() error {
+	select {
+	case <-p.closed:
 		return p.closeErr
+	default:
+		return nil
 	}
+}
 
-	return p.send(message{
+func (p *Peer) Update(updateType string, data any) error {
+	b, err := encodeUpdate(updateType, data)
+	if err != nil {
+		return err
+	}
+
+	return p.sendEncodedUpdate(b)
+}
+
+// encodeUpdate encodes an update once, so it can be sent to many peers
+func encodeUpdate(updateType string, data any) ([]byte, error) {
+	return json.Marshal(message{
 		MessageType: update,
 		Message: Update{
 			Type: updateType,
@@ -110,9 +179,20 @@ func (p *Peer) Update(updateType string, data any) error {
 	})
 }
 
+// sendEncodedUpdate sends an update encoded with encodeUpdate
+func (p *Peer) sendEncodedUpdate(b []byte) error {
+	if err := p.Err(); err != nil {
+		return err
+	}
+
+	return p.write(b)
+}
+
+// Request sends a request and waits for the peer's response. If the peer
+// couldn't handle the request, the error wraps ErrRequestFailed.
 func (p *Peer) Request(ctx context.Context, requestType string, data any) (ReceivedResponse, error) {
-	if p.closeErr != nil {
-		return ReceivedResponse{}, p.closeErr
+	if err := p.Err(); err != nil {
+		return ReceivedResponse{}, err
 	}
 
 	id := p.nextID()
@@ -135,14 +215,14 @@ func (p *Peer) Request(ctx context.Context, requestType string, data any) (Recei
 	}
 
 	select {
-	case res, ok := <-resChan:
-		if !ok {
-			if p.closeErr != nil {
-				return ReceivedResponse{}, p.closeErr
-			}
-			panic("response channel closed unexpectedly")
+	case res := <-resChan:
+		if res.Error != "" {
+			return res, fmt.Errorf("%w: %s", ErrRequestFailed, res.Error)
 		}
 		return res, nil
+	case <-p.closed:
+		p.unregisterRequestID(id)
+		return ReceivedResponse{}, p.closeErr
 	case <-ctx.Done():
 		p.unregisterRequestID(id)
 		return ReceivedResponse{}, ctx.Err()
@@ -150,35 +230,30 @@ func (p *Peer) Request(ctx context.Context, requestType string, data any) (Recei
 }
 
 func (p *Peer) Disconnect() error {
-	if p.closeErr != nil {
-		return p.closeErr
+	if err := p.Err(); err != nil {
+		return err
 	}
 
-	p.fatalError(errors.New("Peer has been disconnected"))
+	p.close(ErrDisconnected)
 
 	return nil
 }
 
-// not proper yet
-func (p *Peer) fatalError(err error) {
-	p.conn.Close()
-	p.closeErr = err
-	p.clearResponseMap()
-}
-
-func (p *Peer) clearResponseMap() {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	for id, resChan := range p.responseMap {
-		close(resChan)
-		delete(p.responseMap, id)
-	}
+// close closes the connection, only the first reason given is kept
+func (p *Peer) close(err error) {
+	p.closeOnce.Do(func() {
+		p.closeErr = err
+		p.conn.Close()
+		close(p.closed)
+	})
 }
 
+// registerRequestID returns the channel the response to request id will be
+// sent on. It is buffered, so the response never waits for the requester.
 func (p *Peer) registerRequestID(id int) chan ReceivedResponse {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	resChan := make(chan ReceivedResponse)
+	resChan := make(chan ReceivedResponse, 1)
 	p.responseMap[id] = resChan
 	return resChan
 }
@@ -186,7 +261,6 @@ func (p *Peer) registerRequestID(id int) chan ReceivedResponse {
 func (p *Peer) unregisterRequestID(id int) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	close(p.responseMap[id])
 	delete(p.responseMap, id)
 }
 
@@ -200,22 +274,31 @@ func (p *Peer) send(m message) error {
 		return err
 	}
 
-	_, err = p.conn.Write(b)
-	if err != nil {
+	return p.write(b)
+}
+
+// write sends an encoded message. A write which doesn't finish within
+// writeTimeout may have sent part of the message, so the connection is closed.
+func (p *Peer) write(b []byte) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
+	p.conn.SetWriteDeadline(time.Now().Add(p.writeTimeout))
+	if _, err := p.conn.Write(b); err != nil {
+		p.close(err)
 		return err
 	}
 
 	return nil
 }
 
+// handle reads messages until the connection is closed, then waits for the
+// requests being handled to finish
 func (p *Peer) handle() {
-	var (
-		u   ReceivedUpdate
-		r   ReceivedRequest
-		res ReceivedResponse
-	)
-	raw := &bytes.Buffer{}
-	d := json.NewDecoder(io.TeeReader(p.conn, raw))
+	defer p.handlers.Wait()
+
+	limiter := &messageLimiter{r: p.conn}
+	d := json.NewDecoder(limiter)
 
 	for {
 		m := struct {
@@ -223,44 +306,57 @@ func (p *Peer) handle() {
 			Message     json.RawMessage `json:"message"`
 		}{}
 
+		// The next message starts where the last one ended
+		limiter.limit = d.InputOffset() + p.maxMessageSize
+
 		err := d.Decode(&m)
 		if errors.Is(err, io.EOF) {
+			p.close(ErrPeerClosed)
 			return
 		} else if err != nil {
-			p.fatalError(err)
-			return
-		} else if p.closeErr != nil {
+			// The decoder can't recover from malformed input, so drop the peer
+			p.close(err)
 			return
 		}
 
 		switch m.MessageType {
 		case update:
+			var u ReceivedUpdate
 			if err := json.Unmarshal(m.Message, &u); err != nil {
-				p.fatalError(err)
+				p.close(err)
 				return
 			}
-			err = p.handleReceivedUpdate(u)
-			if err != nil {
-				p.fatalError(err)
+			if err := p.handleReceivedUpdate(u); err != nil {
+				p.close(err)
+				return
 			}
 		case request:
+			var r ReceivedRequest
 			if err := json.Unmarshal(m.Message, &r); err != nil {
-				p.fatalError(err)
-				continue
+				p.close(err)
+				return
 			}
-			err = p.handleReceivedUpdate(u)
-			if err != nil {
-				p.handleReceivedRequest(r)
+			r.RemoteAddr = p.RemoteAddr()
+
+			select {
+			case p.requests <- struct{}{}:
+			case <-p.closed:
+				return
 			}
+			p.handlers.Go(func() {
+				defer func() { <-p.requests }()
+				p.handleReceivedRequest(r)
+			})
 		case response:
+			var res ReceivedResponse
 			if err := json.Unmarshal(m.Message, &res); err != nil {
-				p.fatalError(err)
-				continue
-			}
-			err = p.handleReceivedUpdate(u)
-			if err != nil {
-				p.handleReceivedResponse(res)
+				p.close(err)
+				return
 			}
+			p.handleReceivedResponse(res)
+		default:
+			p.close(fmt.Errorf("unknown message type %d", m.MessageType))
+			return
 		}
 	}
 }
@@ -278,33 +374,40 @@ func (p *Peer) handleReceivedRequest(r ReceivedRequest) error {
 		err error
 	)
 
-	switch r.Type {
+	switch {
+	case p.requestHandler == nil:
+		err = ErrRequestsNotHandled
 	default:
 		res, err = p.requestHandler(r)
 	}
 
+	// The requester is waiting, so always respond
+	resp := Response{
+		RequestID: r.ID,
+		Data:      res,
+	}
 	if err != nil {
-		return err
+		resp = Response{
+			RequestID: r.ID,
+			Error:     err.Error(),
+		}
 	}
 
 	return p.send(message{
 		MessageType: response,
-		Message: Response{
-			RequestID: r.ID,
-			Data:      res,
-		},
+		Message:     resp,
 	})
 }
 
-func (p *Peer) handleReceivedResponse(u ReceivedResponse) error {
-	p.mu.RLock()
-	resChan, ok := p.responseMap[u.RequestID]
-	p.mu.RUnlock()
-	if !ok {
-		return errors.New("Received response does not match a request")
-	}
+// handleReceivedResponse passes a response to whoever is waiting for it.
+// Responses to requests which have been given up on are dropped.
+func (p *Peer) handleReceivedResponse(res ReceivedResponse) {
+	p.mu.Lock()
+	resChan, ok := p.responseMap[res.RequestID]
+	delete(p.responseMap, res.RequestID)
+	p.mu.Unlock()
 
-	resChan <- u
-	p.unregisterRequestID(u.RequestID)
-	return nil
+	if ok {
+		resChan <- res
+	}
 }
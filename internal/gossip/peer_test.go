@@ -1,6 +1,8 @@
 package gossip
 
 import (
+	"context"
+	"errors"
 	"net"
 	"slices"
 	"testing"
@@ -30,13 +32,13 @@ func logReceivedRequest(t *testing.T) func(ReceivedRequest) (any, error) {
 }
 
 type updateSpy struct { // bad name :/
-	t          *testing.T
-	LastUpdate ReceivedUpdate
+	t       *testing.T
+	Updates chan ReceivedUpdate
 }
 
 func (s *updateSpy) HandleUpdate(u ReceivedUpdate) error {
 	s.t.Log("Received Update - Type:", u.Type, "Data:", string(u.Data))
-	s.LastUpdate = u
+	s.Updates <- u
 
 	return nil
 }
@@ -54,7 +56,7 @@ func (s *requestSpy) ReceiveRequest(r ReceivedRequest) (any, error) {
 func TestPeerUpdate(t *testing.T) {
 	conn1, conn2 := net.Pipe()
 
-	uSpy1 := updateSpy{t: t}
+	uSpy1 := updateSpy{t: t, Updates: make(chan ReceivedUpdate, 1)}
 
 	peer1, err := peerFromConn(conn1, uSpy1.HandleUpdate, logReceivedRequest(t))
 	if err != nil {
@@ -67,12 +69,160 @@ func TestPeerUpdate(t *testing.T) {
 	}
 
 	peer2.Update("type", "data")
-	time.Sleep(time.Millisecond)
-	assertReceivedUpdateEqual(t, uSpy1.LastUpdate, ReceivedUpdate{
-		Type: "type",
-		Data: []byte("\"data\""),
-	})
+	select {
+	case u := <-uSpy1.Updates:
+		assertReceivedUpdateEqual(t, u, ReceivedUpdate{
+			Type: "type",
+			Data: []byte("\"data\""),
+		})
+	case <-time.After(time.Second):
+		t.Fatal("update should be received")
+	}
 
 	peer1.Disconnect()
 	peer2.Disconnect()
 }
+
+func TestPeerRequest(t *testing.T) {
+	conn1, conn2 := net.Pipe()
+
+	rSpy := requestSpy{Response: "response"}
+
+	peer1, err := peerFromConn(conn1, logReceivedUpdate(t), rSpy.ReceiveRequest)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer peer1.Disconnect()
+
+	peer2, err := peerFromConn(conn2, logReceivedUpdate(t), nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer peer2.Disconnect()
+
+	res, err := peer2.Request(context.Background(), "type", "data")
+	if err != nil {
+		t.Fatalf("Request should not return an error: %v", err)
+	}
+	if string(res.Data) != "\"response\"" {
+		t.Errorf("Expected response \"response\", but got %s", res.Data)
+	}
+	if rSpy.LastRequest.Type != "type" || string(rSpy.LastRequest.Data) != "\"data\"" {
+		t.Errorf("Expected request to be received, but got %v", rSpy.LastRequest)
+	}
+
+	// peer2 doesn't handle requests, but should still respond
+	_, err = peer1.Request(context.Background(), "type", "data")
+	if !errors.Is(err, ErrRequestFailed) {
+		t.Errorf("Request should return %v, not %v", ErrRequestFailed, err)
+	}
+}
+
+func TestPeerRequestCancelled(t *testing.T) {
+	conn1, conn2 := net.Pipe()
+
+	block := make(chan struct{})
+	defer close(block)
+
+	peer1, err := peerFromConn(conn1, logReceivedUpdate(t), func(ReceivedRequest) (any, error) {
+		<-block
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer peer1.Disconnect()
+
+	peer2, err := peerFromConn(conn2, logReceivedUpdate(t), nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := peer2.Request(ctx, "type", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Request should return %v, not %v", context.DeadlineExceeded, err)
+	}
+
+	// Waiting requests are given up on when the connection closes
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		peer2.Disconnect()
+	}()
+	if _, err := peer2.Request(context.Background(), "type", nil); !errors.Is(err, ErrDisconnected) {
+		t.Errorf("Request should return %v, not %v", ErrDisconnected, err)
+	}
+}
+
+func TestPeerMaxConcurrentRequests(t *testing.T) {
+	conn1, conn2 := net.Pipe()
+
+	started := make(chan struct{}, 2*MaxConcurrentRequests)
+	block := make(chan struct{})
+
+	peer1, err := peerFromConn(conn1, logReceivedUpdate(t), func(ReceivedRequest) (any, error) {
+		started <- struct{}{}
+		<-block
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer peer1.Disconnect()
+
+	peer2, err := peerFromConn(conn2, logReceivedUpdate(t), nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer peer2.Disconnect()
+
+	errs := make(chan error, 2*MaxConcurrentRequests)
+	for range 2 * MaxConcurrentRequests {
+		go func() {
+			_, err := peer2.Request(context.Background(), "type", nil)
+			errs <- err
+		}()
+	}
+
+	for range MaxConcurrentRequests {
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Fatal("requests up to the limit should be handled at once")
+		}
+	}
+	select {
+	case <-started:
+		t.Fatal("requests over the limit should wait")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// The rest are handled as the first ones finish
+	close(block)
+	for range 2 * MaxConcurrentRequests {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Errorf("Request should not return an error: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("every request should be answered")
+		}
+	}
+}
+
+func TestPeerWriteTimeout(t *testing.T) {
+	conn1, _ := net.Pipe()
+
+	// Nothing reads from the other end, so writes never finish
+	p := newPeer(conn1, DefaultMaxMessageSize, logReceivedUpdate(t), nil)
+	p.writeTimeout = 10 * time.Millisecond
+
+	if err := p.Update("type", "data"); err == nil {
+		t.Fatal("Update should return an error once the write times out")
+	}
+	if p.Err() == nil {
+		t.Error("peer should be disconnected after a write times out")
+	}
+}
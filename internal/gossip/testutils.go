@@ -18,3 +18,17 @@ func CreateReceivedMessage(t *testing.T, messageType string, remoteAddr string,
 		Data:       json.RawMessage(b),
 	}
 }
+
+func CreateReceivedRequest(t *testing.T, requestType string, remoteAddr string, data any) ReceivedRequest {
+	b, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal("Failed to create received request")
+		return ReceivedRequest{}
+	}
+
+	return ReceivedRequest{
+		Type:       requestType,
+		RemoteAddr: remoteAddr,
+		Data:       json.RawMessage(b),
+	}
+}
@@ -5,33 +5,33 @@ import (
 	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
-	"math"
 	"sync"
 
 	"github.com/holiman/uint256"
 	"github.com/zakkbob/go-blockchain/internal/blockchain"
 )
 
-var pi, _ = uint256.FromDecimal("31415926535897932384626433832795028841971693993751058209749445923078164062862")
-
 type Miner struct {
 	MinedBlocks chan *blockchain.Block
 
 	pubkey           ed25519.PublicKey
+	params           *blockchain.ChainParams
 	block            *blockchain.Block
 	partialBlockData []byte
-	difficulty       int
+	lower, upper     *uint256.Int // Bounds the block hash must fall between
 
 	sendCorrectNonceOnce sync.Once
 	stopOnce             sync.Once
 
 	stopWorking chan struct{}
 	wg          sync.WaitGroup
+	mu          sync.Mutex // Held while starting or stopping work, which may happen from several goroutines
 }
 
-func NewMiner(pubkey ed25519.PublicKey) *Miner {
+func NewMiner(pubkey ed25519.PublicKey, params *blockchain.ChainParams) *Miner {
 	m := &Miner{
 		pubkey:      pubkey,
+		params:      params,
 		MinedBlocks: make(chan *blockchain.Block),
 		stopWorking: make(chan struct{}),
 	}
@@ -41,22 +41,25 @@ func NewMiner(pubkey ed25519.PublicKey) *Miner {
 
 // Starts mining a block, using one worker
 // Can be called while already mining
-func (m *Miner) Mine(b blockchain.Block) {
+// Blocks which the chain would reject for their size are never mined
+func (m *Miner) Mine(b blockchain.Block) error {
+	if err := b.VerifyLimits(m.params); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	fmt.Println("Starting new mining work")
-	m.Stop()
+	m.stop()
 
 	b = b.Clone()
 	m.block = &b
-	m.difficulty = m.block.Difficulty
-
-	txsHash := blockchain.HashTransactions(b.Transactions)
+	m.lower, m.upper = blockchain.Target(b.Difficulty)
 
-	data := b.PrevBlock[:]
-	data = append(data, txsHash[:]...)
-	data = append(data, []byte(b.Miner)...)
-	data = binary.LittleEndian.AppendUint64(data, uint64(b.Timestamp))
-
-	m.partialBlockData = data
+	// Everything but the nonce, which is always the final 8 bytes
+	data := b.BlockHeader.Bytes()
+	m.partialBlockData = data[:len(data)-8]
 
 	m.stopWorking = make(chan struct{})
 	m.sendCorrectNonceOnce = sync.Once{}
@@ -65,10 +68,18 @@ func (m *Miner) Mine(b blockchain.Block) {
 	m.wg.Go(func() {
 		m.work()
 	})
+
+	return nil
 }
 
 // Stops mining, can be called multiple times safely
 func (m *Miner) Stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stop()
+}
+
+func (m *Miner) stop() {
 	m.stopOnce.Do(func() {
 		close(m.stopWorking)
 		m.wg.Wait()
@@ -78,7 +89,13 @@ func (m *Miner) Stop() {
 func (m *Miner) processCorrectNonce(n uint64) {
 	m.sendCorrectNonceOnce.Do(func() {
 		m.block.Nonce = n
-		m.MinedBlocks <- m.block
+
+		// Nobody may be waiting for the block if mining is being stopped
+		select {
+		case m.MinedBlocks <- m.block:
+		case <-m.stopWorking:
+		}
+
 		m.partialBlockData = nil
 		m.block = nil
 	})
@@ -108,24 +125,8 @@ func (m *Miner) work() {
 }
 
 func (m *Miner) checkHash(hash [32]byte) bool {
-	digits := 77 - m.difficulty/3
-	divisor := math.Pow(2, float64(m.difficulty%3))
-
-	lower := pi.Clone()
-	div := uint256.NewInt(10)
-	exp := uint256.NewInt(uint64(digits))
-
-	div.Exp(div, exp)
-	lower.Div(lower, div)
-	lower.Mul(lower, div)
-
-	div.Div(div, uint256.NewInt(uint64(divisor)))
-
-	upper := lower.Clone()
-	upper.Add(upper, div)
-
 	uint256Hash := uint256.NewInt(0)
 	uint256Hash.SetBytes(hash[:])
 
-	return uint256Hash.Gt(lower) && uint256Hash.Lt(upper)
+	return uint256Hash.Gt(m.lower) && uint256Hash.Lt(m.upper)
 }
@@ -1,7 +1,9 @@
 package miner_test
 
 import (
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/zakkbob/go-blockchain/internal/blockchain"
 	"github.com/zakkbob/go-blockchain/internal/miner"
@@ -12,13 +14,68 @@ func TestMiner(t *testing.T) {
 
 	b := blockchain.NewGenesisBlock(5)
 
-	m := miner.NewMiner(miner1.PublicKey())
-	m.Mine(b)
+	m := miner.NewMiner(miner1.PublicKey(), blockchain.NewTestParams())
+	if err := m.Mine(b); err != nil {
+		t.Fatalf("Mine should not return an error: %v", err)
+	}
 	mined := <-m.MinedBlocks
 
-	if mined.Verify() != nil {
+	if mined.Verify(blockchain.NewTestParams()) != nil {
 		t.Fatal("Mined block should be valid!")
 	}
 
 	m.Stop()
 }
+
+func TestMinerTooManyTransactions(t *testing.T) {
+	miner1 := blockchain.MustGenerateTestAddress(t)
+	receiver := blockchain.MustGenerateTestAddress(t)
+
+	params := blockchain.NewTestParams()
+	params.MaxBlockTransactions = 1
+
+	txs := []blockchain.Transaction{
+		miner1.NewTransaction(receiver.PublicKey(), 1, 0, 0),
+		miner1.NewTransaction(receiver.PublicKey(), 1, 0, 1),
+	}
+	b := blockchain.NewBlock([32]byte{}, txs, 0, miner1.PublicKey())
+
+	m := miner.NewMiner(miner1.PublicKey(), params)
+	if err := m.Mine(b); !errors.Is(err, blockchain.ErrTooManyTransactions) {
+		t.Errorf("Mine should return %v, not %v", blockchain.ErrTooManyTransactions, err)
+	}
+}
+
+func TestMinerRestart(t *testing.T) {
+	miner1 := blockchain.MustGenerateTestAddress(t)
+
+	m := miner.NewMiner(miner1.PublicKey(), blockchain.NewTestParams())
+	defer m.Stop()
+
+	// Found straight away, but never received
+	if err := m.Mine(blockchain.NewBlock([32]byte{1}, []blockchain.Transaction{}, 0, miner1.PublicKey())); err != nil {
+		t.Fatalf("Mine should not return an error: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// Work may be restarted from several goroutines at once
+	done := make(chan struct{})
+	for range 2 {
+		go func() {
+			m.Mine(blockchain.NewBlock([32]byte{2}, []blockchain.Transaction{}, 0, miner1.PublicKey()))
+			done <- struct{}{}
+		}()
+	}
+	for range 2 {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("Mine should not wait for the previous block to be received")
+		}
+	}
+
+	mined := <-m.MinedBlocks
+	if mined.PrevBlock != [32]byte{2} {
+		t.Error("Mined block should be the latest work")
+	}
+}
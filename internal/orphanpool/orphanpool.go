@@ -0,0 +1,158 @@
+package orphanpool
+
+import (
+	"sync"
+	"time"
+
+	"github.com/zakkbob/go-blockchain/internal/blockchain"
+)
+
+type orphan struct {
+	block blockchain.Block
+	added time.Time
+}
+
+// Pool holds blocks whose parent isn't known yet, until the parent arrives.
+// It is bounded by the number of blocks and how long they are kept, as any
+// peer can fill it with blocks which will never connect.
+type Pool struct {
+	maxSize int
+	maxAge  time.Duration
+	now     func() time.Time
+
+	orphans map[[32]byte]*orphan // indexed by block hash
+	byPrev  map[[32]byte]map[[32]byte]struct{}
+
+	mu sync.Mutex
+}
+
+func New(maxSize int, maxAge time.Duration) *Pool {
+	return &Pool{
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		now:     time.Now,
+		orphans: map[[32]byte]*orphan{},
+		byPrev:  map[[32]byte]map[[32]byte]struct{}{},
+	}
+}
+
+// SetClock replaces the clock used to expire orphans
+func (p *Pool) SetClock(now func() time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.now = now
+}
+
+func (p *Pool) Size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.orphans)
+}
+
+func (p *Pool) Has(hash [32]byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.orphans[hash]
+	return ok
+}
+
+// Add keeps b until its parent arrives, evicting the oldest orphan if the
+// pool is full. It returns false if b is already in the pool.
+func (p *Pool) Add(b blockchain.Block) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	hash := b.Hash()
+	if _, ok := p.orphans[hash]; ok {
+		return false
+	}
+
+	p.expire()
+	if len(p.orphans) >= p.maxSize {
+		p.evictOldest()
+	}
+
+	p.orphans[hash] = &orphan{
+		block: b.Clone(),
+		added: p.now(),
+	}
+	if p.byPrev[b.PrevBlock] == nil {
+		p.byPrev[b.PrevBlock] = map[[32]byte]struct{}{}
+	}
+	p.byPrev[b.PrevBlock][hash] = struct{}{}
+
+	return true
+}
+
+// Children removes and returns the orphans whose parent is prev, now that it
+// can be connected
+func (p *Pool) Children(prev [32]byte) []blockchain.Block {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.expire()
+
+	children := make([]blockchain.Block, 0, len(p.byPrev[prev]))
+	for hash := range p.byPrev[prev] {
+		children = append(children, p.orphans[hash].block)
+		p.remove(hash)
+	}
+	return children
+}
+
+// MissingAncestor returns the hash of the earliest unknown block needed to
+// connect the orphan with hash, following its parents through the pool
+func (p *Pool) MissingAncestor(hash [32]byte) [32]byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for {
+		o, ok := p.orphans[hash]
+		if !ok {
+			return hash
+		}
+		hash = o.block.PrevBlock
+	}
+}
+
+// expire removes orphans older than maxAge, the lock must be held
+func (p *Pool) expire() {
+	cutoff := p.now().Add(-p.maxAge)
+	for hash, o := range p.orphans {
+		if o.added.Before(cutoff) {
+			p.remove(hash)
+		}
+	}
+}
+
+// evictOldest removes the orphan which was added first, the lock must be held
+func (p *Pool) evictOldest() {
+	var (
+		oldest [32]byte
+		found  bool
+		added  time.Time
+	)
+	for hash, o := range p.orphans {
+		if !found || o.added.Before(added) {
+			oldest, added, found = hash, o.added, true
+		}
+	}
+	if found {
+		p.remove(oldest)
+	}
+}
+
+// remove deletes an orphan and its parent index entry, the lock must be held
+func (p *Pool) remove(hash [32]byte) {
+	o, ok := p.orphans[hash]
+	if !ok {
+		return
+	}
+	delete(p.orphans, hash)
+
+	siblings := p.byPrev[o.block.PrevBlock]
+	delete(siblings, hash)
+	if len(siblings) == 0 {
+		delete(p.byPrev, o.block.PrevBlock)
+	}
+}
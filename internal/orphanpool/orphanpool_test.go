@@ -0,0 +1,91 @@
+package orphanpool_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zakkbob/go-blockchain/internal/blockchain"
+	"github.com/zakkbob/go-blockchain/internal/orphanpool"
+)
+
+// testChain returns n mined blocks following genesis
+func testChain(t *testing.T, n int) (*blockchain.Block, []blockchain.Block) {
+	t.Helper()
+	miner := blockchain.MustGenerateTestAddress(t)
+	_, genesis := blockchain.MustCreateTestLedger(t)
+
+	blocks := make([]blockchain.Block, 0, n)
+	prev := genesis
+	for range n {
+		b := blockchain.NewTestBlock(t, prev, []blockchain.Transaction{}, 0, miner.PublicKey())
+		blocks = append(blocks, b)
+		prev = &b
+	}
+	return genesis, blocks
+}
+
+func TestPoolChildren(t *testing.T) {
+	genesis, blocks := testChain(t, 3)
+	p := orphanpool.New(10, time.Hour)
+
+	if !p.Add(blocks[2]) || !p.Add(blocks[1]) {
+		t.Fatal("Add should accept new orphans")
+	}
+	if p.Add(blocks[1]) {
+		t.Error("Add should ignore orphans already in the pool")
+	}
+
+	if got := p.MissingAncestor(blocks[2].Hash()); got != blocks[0].Hash() {
+		t.Error("missing ancestor should be the first block, which isn't in the pool")
+	}
+
+	if children := p.Children(genesis.Hash()); len(children) != 0 {
+		t.Errorf("genesis has no orphaned children, got %d", len(children))
+	}
+
+	children := p.Children(blocks[0].Hash())
+	if len(children) != 1 || children[0].Hash() != blocks[1].Hash() {
+		t.Fatal("the second block should be a child of the first")
+	}
+	if p.Has(blocks[1].Hash()) || p.Size() != 1 {
+		t.Error("returned children should be removed from the pool")
+	}
+}
+
+func TestPoolMaxSize(t *testing.T) {
+	_, blocks := testChain(t, 3)
+	now := time.Unix(0, 0)
+
+	p := orphanpool.New(2, time.Hour)
+	p.SetClock(func() time.Time { return now })
+
+	for _, b := range blocks {
+		p.Add(b)
+		now = now.Add(time.Second)
+	}
+
+	if p.Size() != 2 {
+		t.Fatalf("expected 2 orphans; got %d", p.Size())
+	}
+	if p.Has(blocks[0].Hash()) {
+		t.Error("the oldest orphan should be evicted")
+	}
+}
+
+func TestPoolMaxAge(t *testing.T) {
+	_, blocks := testChain(t, 2)
+	now := time.Unix(0, 0)
+
+	p := orphanpool.New(10, time.Minute)
+	p.SetClock(func() time.Time { return now })
+
+	p.Add(blocks[1])
+	now = now.Add(2 * time.Minute)
+
+	if children := p.Children(blocks[0].Hash()); len(children) != 0 {
+		t.Error("expired orphans should not be returned")
+	}
+	if p.Size() != 0 {
+		t.Error("expired orphans should be removed")
+	}
+}
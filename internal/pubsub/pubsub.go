@@ -0,0 +1,59 @@
+package pubsub
+
+import "sync"
+
+// Subscribers is a set of functions which are each called with every value
+// published, in the order they subscribed. The zero value has no subscribers
+// and is ready to use.
+//
+// Subscribers is safe for concurrent use. Values are delivered without any
+// lock held, so a subscriber may subscribe or unsubscribe, and whatever
+// publishes can be used from it.
+type Subscribers[T any] struct {
+	fns    map[int]func(T)
+	nextID int
+	mu     sync.Mutex
+}
+
+// Subscribe registers fn to be called with each value published from now on.
+// The returned function cancels the subscription.
+func (s *Subscribers[T]) Subscribe(fn func(T)) (unsubscribe func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.fns == nil {
+		s.fns = map[int]func(T){}
+	}
+	id := s.nextID
+	s.nextID++
+	s.fns[id] = fn
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.fns, id)
+	}
+}
+
+// Publish calls every subscriber with each value in turn. Subscribers are
+// found once, so all of the values go to the same ones.
+func (s *Subscribers[T]) Publish(values ...T) {
+	if len(values) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	fns := make([]func(T), 0, len(s.fns))
+	for id := range s.nextID {
+		if fn, ok := s.fns[id]; ok {
+			fns = append(fns, fn)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, v := range values {
+		for _, fn := range fns {
+			fn(v)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package pubsub_test
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/zakkbob/go-blockchain/internal/pubsub"
+)
+
+func TestSubscribers(t *testing.T) {
+	var s pubsub.Subscribers[int]
+	var got []string
+
+	s.Subscribe(func(v int) { got = append(got, fmt.Sprint("a", v)) })
+	unsubscribe := s.Subscribe(func(v int) { got = append(got, fmt.Sprint("b", v)) })
+
+	// Values go to every subscriber in turn, in the order they subscribed
+	s.Publish(1, 2)
+	if expected := []string{"a1", "b1", "a2", "b2"}; !slices.Equal(got, expected) {
+		t.Errorf("expected %v; got %v", expected, got)
+	}
+
+	got = nil
+	unsubscribe()
+	s.Publish(3)
+	if expected := []string{"a3"}; !slices.Equal(got, expected) {
+		t.Errorf("unsubscribed function should not be called, got %v", got)
+	}
+}
+
+func TestSubscribersReentrant(t *testing.T) {
+	var s pubsub.Subscribers[int]
+	calls := 0
+
+	// Subscribing from a subscriber must not deadlock, and only takes effect
+	// for later values
+	s.Subscribe(func(int) {
+		calls++
+		s.Subscribe(func(int) { calls++ })
+	})
+	s.Publish(1)
+	if calls != 1 {
+		t.Errorf("expected 1 call; got %d", calls)
+	}
+}
@@ -0,0 +1,41 @@
+package txpool
+
+import "github.com/zakkbob/go-blockchain/internal/blockchain"
+
+// Subscribe registers fn to be called with each transaction added which pays
+// enough to be mined in the next block, so a block being mined without it is
+// worth less than it could be. Transactions are delivered once the pool is
+// unlocked, so fn may use the pool, but may be called from several goroutines
+// at once. The returned function cancels the subscription.
+func (p *Pool) Subscribe(fn func(blockchain.Transaction)) (unsubscribe func()) {
+	return p.subscribers.Subscribe(fn)
+}
+
+// publish delivers tx to every subscriber
+func (p *Pool) publish(tx blockchain.Transaction) {
+	p.subscribers.Publish(tx)
+}
+
+// inNextBlock reports whether e is ready and among the best transactions that
+// fit in a block. The block's header and coinbase aren't counted, so this errs
+// towards including it.
+func (p *Pool) inNextBlock(e *entry) bool {
+	if !e.ready {
+		return false
+	}
+
+	var (
+		count = 1
+		space = p.params.NewBlockSpace(0)
+	)
+	for _, o := range p.queue {
+		if o == e || !o.ready || !o.better(e) {
+			continue
+		}
+		count++
+		space.Add(o.size)
+	}
+
+	// Room is left for the coinbase
+	return count < p.params.MaxBlockTransactions && space.Fits(e.size)
+}
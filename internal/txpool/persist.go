@@ -0,0 +1,106 @@
+package txpool
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/zakkbob/go-blockchain/internal/blockchain"
+)
+
+// savedTransaction is a pooled transaction as it is saved to disk, with when
+// it arrived so it still expires on time after being reloaded
+type savedTransaction struct {
+	Transaction blockchain.Transaction `json:"transaction"`
+	Added       time.Time              `json:"added"`
+}
+
+// Save writes every transaction in the pool to path, oldest first, so they
+// can be reloaded after a restart. The file is replaced in one step, so a
+// crash part way through leaves the previous one intact.
+func (p *Pool) Save(path string) error {
+	p.mu.RLock()
+	entries := make([]*entry, 0, len(p.entries))
+	for _, e := range p.entries {
+		entries = append(entries, e)
+	}
+	p.mu.RUnlock()
+
+	slices.SortFunc(entries, func(a, b *entry) int {
+		return cmp.Compare(a.seq, b.seq)
+	})
+
+	saved := make([]savedTransaction, len(entries))
+	for i, e := range entries {
+		saved[i] = savedTransaction{Transaction: e.tx, Added: e.added}
+	}
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return fmt.Errorf("encoding pool: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("creating pool file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing pool file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("syncing pool file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("closing pool file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("replacing pool file: %w", err)
+	}
+	return nil
+}
+
+// Load adds the transactions saved at path by Save. Each is checked against
+// the current state as if it had just arrived, so any confirmed, invalidated
+// or expired while the node was down are skipped. It returns how many were
+// added. A missing file loads nothing.
+func (p *Pool) Load(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("reading pool file: %w", err)
+	}
+
+	var saved []savedTransaction
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return 0, fmt.Errorf("decoding pool file: %w", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	added := 0
+	for _, s := range saved {
+		// It was checked when it first arrived, but the file may have been
+		// tampered with since
+		if err := s.Transaction.Verify(); err != nil {
+			continue
+		}
+		if _, err := p.add(s.Transaction, s.Added); err == nil {
+			added++
+		}
+	}
+	return added, nil
+}
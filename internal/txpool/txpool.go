@@ -1,22 +1,515 @@
 package txpool
 
-import "github.com/zakkbob/go-blockchain/internal/blockchain"
+import (
+	"cmp"
+	"container/heap"
+	"crypto/ed25519"
+	"errors"
+	"maps"
+	"math/bits"
+	"slices"
+	"sync"
+	"time"
 
+	"github.com/zakkbob/go-blockchain/internal/blockchain"
+	"github.com/zakkbob/go-blockchain/internal/pubsub"
+)
+
+var (
+	ErrTransactionTooLarge  = errors.New("transaction is too large to fit in a block")
+	ErrDuplicateTransaction = errors.New("transaction is already in the pool")
+	ErrFeeTooLow            = errors.New("pool is full of transactions paying a higher fee rate")
+	ErrNonceTooLow          = errors.New("transaction nonce has already been used")
+	ErrNonceTooHigh         = errors.New("transaction nonce is too far ahead of the sender's confirmed nonce")
+	ErrReplacementTooCheap  = errors.New("a transaction with this nonce is already in the pool, and the fee is not enough higher to replace it")
+	ErrInsufficientBalance  = errors.New("sender cannot afford this transaction as well as those already in the pool")
+	ErrTransactionExpired   = errors.New("transaction has waited in the pool too long")
+)
+
+// MinFeeBump is how many percent more fee a transaction must pay than the one
+// with the same sender and nonce in the pool to replace it. Without a minimum,
+// a sender could have the network relay endless replacements for almost free.
+const MinFeeBump = 10
+
+// MaxNonceGap is how far past a sender's confirmed nonce a transaction's nonce
+// may be. Parked transactions can't be mined, so without a limit a sender
+// could fill the pool with them for free.
+const MaxNonceGap = 64
+
+// State is the confirmed account state transactions are checked against,
+// usually the best chain of a Ledger
+type State interface {
+	Balance(pubkey ed25519.PublicKey) uint64
+	Nonce(pubkey ed25519.PublicKey) uint64
+}
+
+// entry is a transaction waiting in the pool
+type entry struct {
+	tx    blockchain.Transaction
+	hash  [32]byte
+	size  int       // Encoded size, which the fee rate is worked out from
+	seq   uint64    // Order added, so older transactions win ties
+	added time.Time // When it first arrived, so it can expire
+	index int       // Position in the eviction queue
+	ready bool      // Follows on from the sender's confirmed nonce, so can be mined now
+}
+
+// better reports whether e should be mined before o. Transactions paying a
+// higher fee per byte come first.
+func (e *entry) better(o *entry) bool {
+	if c := compareFeeRate(e.tx.Fee, e.size, o.tx.Fee, o.size); c != 0 {
+		return c > 0
+	}
+	return e.seq < o.seq
+}
+
+// compareFeeRate compares feeA/sizeA with feeB/sizeB, without dividing or
+// overflowing
+func compareFeeRate(feeA uint64, sizeA int, feeB uint64, sizeB int) int {
+	hiA, loA := bits.Mul64(feeA, uint64(sizeB))
+	hiB, loB := bits.Mul64(feeB, uint64(sizeA))
+	if c := cmp.Compare(hiA, hiB); c != 0 {
+		return c
+	}
+	return cmp.Compare(loA, loB)
+}
+
+// keepOver reports whether e should be kept over o when the pool is full.
+// Parked transactions are evicted first, as they can't be mined yet, then
+// those paying the lowest fee rate.
+func (e *entry) keepOver(o *entry) bool {
+	if e.ready != o.ready {
+		return e.ready
+	}
+	return e.better(o)
+}
+
+// evictionQueue is a heap with the transaction to evict first on top
+type evictionQueue []*entry
+
+func (q evictionQueue) Len() int           { return len(q) }
+func (q evictionQueue) Less(i, j int) bool { return q[j].keepOver(q[i]) }
+
+func (q evictionQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *evictionQueue) Push(x any) {
+	e := x.(*entry)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+
+func (q *evictionQueue) Pop() any {
+	old := *q
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return e
+}
+
+// Pool holds transactions waiting to be mined, up to a maximum count and total
+// encoded size. Once full, parked transactions and then those paying the
+// lowest fee rate are evicted to make room for better ones. Transactions which
+// still haven't been mined after a maximum age are dropped, so the sender can
+// tell they won't be.
+//
+// Every sender must be able to afford all of their transactions in the pool
+// at once. Transactions whose nonce leaves a gap after the sender's confirmed
+// nonce are parked until the gap is filled, and may be at most MaxNonceGap
+// ahead of it.
+//
+// A Pool is safe for concurrent use.
 type Pool struct {
-	txs []blockchain.Transaction
+	params   *blockchain.ChainParams
+	state    State
+	maxCount int
+	maxBytes int
+	maxAge   time.Duration
+	now      func() time.Time
+
+	entries map[[32]byte]*entry
+	senders map[string]map[uint64]*entry // Indexed by sender public key, then nonce
+	queue   evictionQueue
+	bytes   int
+	nextSeq uint64
+
+	subscribers pubsub.Subscribers[blockchain.Transaction]
+
+	mu sync.RWMutex
 }
 
+func NewPool(params *blockchain.ChainParams, state State, maxCount int, maxBytes int, maxAge time.Duration) *Pool {
+	return &Pool{
+		params:   params,
+		state:    state,
+		maxCount: maxCount,
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+		now:      time.Now,
+		entries:  map[[32]byte]*entry{},
+		senders:  map[string]map[uint64]*entry{},
+	}
+}
+
+// SetClock replaces the clock used to expire transactions
+func (p *Pool) SetClock(now func() time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.now = now
+}
+
+// Size returns the number of transactions in the pool
 func (p *Pool) Size() int {
-	return len(p.txs)
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.entries)
+}
+
+// Bytes returns the total encoded size of the transactions in the pool
+func (p *Pool) Bytes() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.bytes
 }
 
-func (p *Pool) Add(tx blockchain.Transaction) {
-	p.txs = append(p.txs, tx)
+// Has reports whether a transaction is in the pool
+func (p *Pool) Has(hash [32]byte) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	_, ok := p.entries[hash]
+	return ok
 }
 
-func (p *Pool) Get(n int) []blockchain.Transaction {
-	n = min(n, len(p.txs))
-	txs := p.txs[:n]
-	p.txs = p.txs[n:]
+// Add queues a transaction, unless it could never be included in a block or
+// is already queued. The nonce must not have been used yet, nor be more than
+// MaxNonceGap ahead of the sender's confirmed nonce, and the sender must be
+// able to afford it along with their other pending transactions. If the
+// sender already has a transaction with the same nonce queued, it is replaced
+// when this pays at least MinFeeBump percent more fee. If the pool is full,
+// parked transactions and those paying a lower fee rate are evicted to make
+// room. If there are none, the transaction is rejected and the pool is left
+// unchanged, apart from dropping any expired transactions.
+//
+// Subscribers are told about the transaction if it pays enough to be mined in
+// the next block.
+func (p *Pool) Add(tx blockchain.Transaction) error {
+	p.mu.Lock()
+	e, err := p.add(tx, p.now())
+	notify := err == nil && p.inNextBlock(e)
+	p.mu.Unlock()
+
+	if notify {
+		p.publish(tx)
+	}
+	return err
+}
+
+// add queues a transaction which first arrived at added
+func (p *Pool) add(tx blockchain.Transaction, added time.Time) (*entry, error) {
+	p.expire()
+	if added.Before(p.now().Add(-p.maxAge)) {
+		return nil, ErrTransactionExpired
+	}
+
+	size := tx.Size()
+	if size > p.params.MaxBlockSize || size > p.maxBytes {
+		return nil, ErrTransactionTooLarge
+	}
+
+	hash := tx.Hash()
+	if _, ok := p.entries[hash]; ok {
+		return nil, ErrDuplicateTransaction
+	}
+
+	replaced, err := p.checkSender(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	sender := string(tx.Sender)
+	prev := p.senders[sender][tx.Nonce-1]
+	e := &entry{
+		tx:    tx,
+		hash:  hash,
+		size:  size,
+		seq:   p.nextSeq,
+		added: added,
+		ready: tx.Nonce == p.state.Nonce(tx.Sender) || (prev != nil && prev.ready),
+	}
+
+	var (
+		evicted []*entry
+		count   = len(p.entries) + 1
+		bytes   = p.bytes + size
+	)
+
+	// The replaced transaction makes room first, but is put back with the
+	// others if there still isn't enough
+	if replaced != nil {
+		heap.Remove(&p.queue, replaced.index)
+		evicted = append(evicted, replaced)
+		count--
+		bytes -= replaced.size
+	}
+
+	for count > p.maxCount || bytes > p.maxBytes {
+		if len(p.queue) == 0 || !e.keepOver(p.queue[0]) {
+			for _, ev := range evicted {
+				heap.Push(&p.queue, ev)
+			}
+			return nil, ErrFeeTooLow
+		}
+
+		worst := heap.Pop(&p.queue).(*entry)
+		evicted = append(evicted, worst)
+		count--
+		bytes -= worst.size
+	}
+
+	for _, ev := range evicted {
+		p.forget(ev)
+	}
+
+	p.nextSeq++
+	p.entries[hash] = e
+	p.bytes += size
+	heap.Push(&p.queue, e)
+
+	if p.senders[sender] == nil {
+		p.senders[sender] = map[uint64]*entry{}
+	}
+	p.senders[sender][tx.Nonce] = e
+
+	// Evicting a sender's earlier nonce parks the ones after it
+	for _, ev := range evicted {
+		p.updateSender(string(ev.tx.Sender))
+	}
+	p.updateSender(sender)
+
+	return e, nil
+}
+
+// checkSender checks a transaction against its sender's confirmed state and
+// the transactions they already have in the pool. If it replaces one of them,
+// that is returned.
+func (p *Pool) checkSender(tx blockchain.Transaction) (*entry, error) {
+	confirmed := p.state.Nonce(tx.Sender)
+	if tx.Nonce < confirmed {
+		return nil, ErrNonceTooLow
+	}
+	if tx.Nonce-confirmed >= MaxNonceGap {
+		return nil, ErrNonceTooHigh
+	}
+
+	pending := p.senders[string(tx.Sender)]
+	replaced := pending[tx.Nonce]
+	if replaced != nil && !paysReplacementFee(tx.Fee, replaced.tx.Fee) {
+		return nil, ErrReplacementTooCheap
+	}
+
+	// The replaced transaction's payment won't be made
+	spent := tx.Cost()
+	for _, e := range pending {
+		if e == replaced {
+			continue
+		}
+		if spent+e.tx.Cost() < spent {
+			return nil, ErrInsufficientBalance
+		}
+		spent += e.tx.Cost()
+	}
+	if spent > p.state.Balance(tx.Sender) {
+		return nil, ErrInsufficientBalance
+	}
+
+	return replaced, nil
+}
+
+// paysReplacementFee reports whether fee is at least MinFeeBump percent more
+// than old, and more than it at all
+func paysReplacementFee(fee uint64, old uint64) bool {
+	// fee*100 compared with old*(100+MinFeeBump), without overflowing
+	return fee > old && compareFeeRate(fee, 100+MinFeeBump, old, 100) >= 0
+}
+
+// updateSender checks a sender's transactions against their confirmed state,
+// in nonce order. Any which are now stale, unaffordable or too far ahead are
+// dropped, and the rest are marked ready if no nonce is missing before them.
+func (p *Pool) updateSender(sender string) int {
+	pending := p.senders[sender]
+	if len(pending) == 0 {
+		delete(p.senders, sender)
+		return 0
+	}
+
+	var (
+		pubkey    = ed25519.PublicKey(sender)
+		confirmed = p.state.Nonce(pubkey)
+		next      = confirmed
+		balance   = p.state.Balance(pubkey)
+		spent     uint64
+		dropped   int
+	)
+
+	for _, nonce := range slices.Sorted(maps.Keys(pending)) {
+		e := pending[nonce]
+		cost := e.tx.Cost()
+
+		if nonce < confirmed || nonce-confirmed >= MaxNonceGap || spent+cost < spent || spent+cost > balance {
+			heap.Remove(&p.queue, e.index)
+			p.forget(e)
+			dropped++
+			continue
+		}
+
+		spent += cost
+		if ready := nonce == next; ready != e.ready {
+			// Being parked changes how soon it is evicted
+			e.ready = ready
+			heap.Fix(&p.queue, e.index)
+		}
+		if e.ready {
+			next++
+		}
+	}
+
+	if len(pending) == 0 {
+		delete(p.senders, sender)
+	}
+	return dropped
+}
+
+// Revalidate checks every transaction against the current state, after the
+// best chain has changed. Transactions which can no longer be mined or have
+// expired are dropped, and parked ones whose gap has been filled become ready.
+// It returns how many were dropped.
+func (p *Pool) Revalidate() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	dropped := p.expire()
+	for sender := range p.senders {
+		dropped += p.updateSender(sender)
+	}
+	return dropped
+}
+
+// expire drops transactions older than maxAge, returning how many were
+// dropped. The lock must be held.
+func (p *Pool) expire() int {
+	var (
+		cutoff  = p.now().Add(-p.maxAge)
+		senders = map[string]struct{}{}
+		dropped int
+	)
+	for _, e := range p.entries {
+		if e.added.Before(cutoff) {
+			heap.Remove(&p.queue, e.index)
+			p.forget(e)
+			senders[string(e.tx.Sender)] = struct{}{}
+			dropped++
+		}
+	}
+
+	// Their later nonces are parked until the gap is filled again
+	for sender := range senders {
+		dropped += p.updateSender(sender)
+	}
+	return dropped
+}
+
+// forget drops an entry which has already been taken out of the eviction
+// queue
+func (p *Pool) forget(e *entry) {
+	delete(p.entries, e.hash)
+	delete(p.senders[string(e.tx.Sender)], e.tx.Nonce)
+	p.bytes -= e.size
+}
+
+// Snapshot returns every transaction which can be mined now, best first, as
+// they were at a single moment. Block templates are built from it, so
+// transactions added or removed while one is built can't leave it half
+// updated. Parked transactions are left out, as they can't be mined yet, and
+// everything stays in the pool until it is confirmed or removed. Expired
+// transactions are dropped first, so they are never mined.
+func (p *Pool) Snapshot() []blockchain.Transaction {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.expire()
+	entries := p.ready()
+	txs := make([]blockchain.Transaction, len(entries))
+	for i, e := range entries {
+		txs[i] = e.tx
+	}
 	return txs
 }
+
+// ready returns the entries which aren't parked, best first
+func (p *Pool) ready() []*entry {
+	entries := make([]*entry, 0, len(p.queue))
+	for _, e := range p.queue {
+		if e.ready {
+			entries = append(entries, e)
+		}
+	}
+	slices.SortFunc(entries, func(a, b *entry) int {
+		if a.better(b) {
+			return -1
+		}
+		return 1
+	})
+	return entries
+}
+
+// Remove drops a transaction from the pool, reporting whether it was there.
+// The sender's later transactions are parked until the nonce is filled again.
+func (p *Pool) Remove(hash [32]byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.remove(hash)
+}
+
+func (p *Pool) remove(hash [32]byte) bool {
+	e, ok := p.entries[hash]
+	if !ok {
+		return false
+	}
+
+	heap.Remove(&p.queue, e.index)
+	p.forget(e)
+	p.updateSender(string(e.tx.Sender))
+	return true
+}
+
+// RemoveConfirmed drops every transaction a block includes, as they can't be
+// included again. It returns how many were removed.
+func (p *Pool) RemoveConfirmed(b blockchain.Block) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	removed := 0
+	for _, tx := range b.Transactions {
+		if p.remove(tx.Hash()) {
+			removed++
+		}
+	}
+	return removed
+}
+
+// Restore returns the transactions of a block which is no longer part of the
+// best chain to the pool, so they can be mined again. Any the new chain also
+// includes are rejected, or removed again as its blocks are connected.
+// Subscribers aren't told about them, as a new head follows.
+func (p *Pool) Restore(b blockchain.Block) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// The coinbase is only valid in the block it was mined in
+	for _, tx := range b.Transactions[min(1, len(b.Transactions)):] {
+		p.add(tx, p.now())
+	}
+}
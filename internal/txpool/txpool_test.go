@@ -0,0 +1,687 @@
+package txpool_test
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zakkbob/go-blockchain/internal/blockchain"
+	"github.com/zakkbob/go-blockchain/internal/txpool"
+)
+
+// testState is the confirmed state of a few accounts
+type testState struct {
+	balances map[string]uint64
+	nonces   map[string]uint64
+}
+
+func newTestState(funded ...blockchain.Address) *testState {
+	s := &testState{balances: map[string]uint64{}, nonces: map[string]uint64{}}
+	for _, a := range funded {
+		s.balances[string(a.PublicKey())] = 1 << 20
+	}
+	return s
+}
+
+func (s *testState) Balance(pubkey ed25519.PublicKey) uint64 { return s.balances[string(pubkey)] }
+func (s *testState) Nonce(pubkey ed25519.PublicKey) uint64   { return s.nonces[string(pubkey)] }
+
+func newTestPool(state txpool.State) *txpool.Pool {
+	return txpool.NewPool(blockchain.NewTestParams(), state, 100, 1<<20, time.Hour)
+}
+
+func assertPoolHashes(t *testing.T, p *txpool.Pool, expected ...blockchain.Transaction) {
+	t.Helper()
+
+	if p.Size() != len(expected) {
+		t.Fatalf("expected %d transactions in the pool; got %d", len(expected), p.Size())
+	}
+	for _, tx := range expected {
+		if !p.Has(tx.Hash()) {
+			t.Errorf("expected transaction %s in the pool", tx.String())
+		}
+	}
+}
+
+func TestPoolAdd(t *testing.T) {
+	sender := blockchain.MustGenerateTestAddress(t)
+	receiver := blockchain.MustGenerateTestAddress(t)
+
+	tx1 := sender.NewTransaction(receiver.PublicKey(), 1, 0, 0)
+	tx2 := sender.NewTransaction(receiver.PublicKey(), 1, 0, 1)
+
+	p := newTestPool(newTestState(sender))
+	p.Add(tx1)
+	p.Add(tx2)
+	if err := p.Add(tx1); !errors.Is(err, txpool.ErrDuplicateTransaction) {
+		t.Errorf("Add should return %v, not %v", txpool.ErrDuplicateTransaction, err)
+	}
+	assertPoolHashes(t, p, tx1, tx2)
+
+	if p.Bytes() != tx1.Size()+tx2.Size() {
+		t.Errorf("expected pool of %d bytes; got %d", tx1.Size()+tx2.Size(), p.Bytes())
+	}
+
+	if !p.Remove(tx1.Hash()) || p.Remove(tx1.Hash()) {
+		t.Error("Remove should only remove a transaction once")
+	}
+	assertPoolHashes(t, p, tx2)
+	if p.Bytes() != tx2.Size() {
+		t.Errorf("expected pool of %d bytes; got %d", tx2.Size(), p.Bytes())
+	}
+}
+
+func TestPoolSnapshot(t *testing.T) {
+	sender := blockchain.MustGenerateTestAddress(t)
+	receiver := blockchain.MustGenerateTestAddress(t)
+
+	low := sender.NewTransaction(receiver.PublicKey(), 1, 1, 0)
+	high := sender.NewTransaction(receiver.PublicKey(), 1, 5, 1)
+	first := sender.NewTransaction(receiver.PublicKey(), 1, 3, 2)
+	second := sender.NewTransaction(receiver.PublicKey(), 1, 3, 3)
+
+	p := newTestPool(newTestState(sender))
+	for _, tx := range []blockchain.Transaction{low, first, high, second} {
+		p.Add(tx)
+	}
+
+	// Highest fee rate first, ties go to the oldest
+	expected := []blockchain.Transaction{high, first, second, low}
+
+	txs := p.Snapshot()
+	if len(txs) != len(expected) {
+		t.Fatalf("expected %d transactions; got %d", len(expected), len(txs))
+	}
+	for i, tx := range txs {
+		if tx.Hash() != expected[i].Hash() {
+			t.Errorf("transaction %d should have nonce %d, not %d", i, expected[i].Nonce, tx.Nonce)
+		}
+	}
+
+	if p.Size() != 4 {
+		t.Errorf("Snapshot should leave transactions in the pool, %d left", p.Size())
+	}
+}
+
+func TestPoolLimits(t *testing.T) {
+	sender := blockchain.MustGenerateTestAddress(t)
+	receiver := blockchain.MustGenerateTestAddress(t)
+
+	txs := make([]blockchain.Transaction, 4)
+	for i := range txs {
+		txs[i] = sender.NewTransaction(receiver.PublicKey(), 1, uint64(10*(i+1)), uint64(i))
+	}
+	size := txs[0].Size()
+	// The lowest fee, from a sender with nothing else in the pool
+	cheapSender := blockchain.MustGenerateTestAddress(t)
+	cheap := cheapSender.NewTransaction(receiver.PublicKey(), 1, 5, 0)
+
+	// The pool doesn't verify transactions, so Data can be used to pad them
+	// out to any size. Each has its own sender, so none are parked.
+	// A transaction with a larger fee, but paying less per byte
+	paddedSender := blockchain.MustGenerateTestAddress(t)
+	padded := paddedSender.NewTransaction(receiver.PublicKey(), 1, 15, 0)
+	padded.Data = make([]byte, 1000)
+	// A large transaction paying the most per byte
+	largeSender := blockchain.MustGenerateTestAddress(t)
+	large := largeSender.NewTransaction(receiver.PublicKey(), 1, 1000, 0)
+	large.Data = make([]byte, 100)
+
+	tests := []struct {
+		name     string
+		maxCount int
+		maxBytes int
+		add      []blockchain.Transaction
+		errs     []error
+		expected []blockchain.Transaction
+	}{
+		{
+			name:     "evicts lowest fee when count is full",
+			maxCount: 2,
+			maxBytes: 1 << 20,
+			add:      []blockchain.Transaction{txs[1], txs[0], txs[2]},
+			errs:     []error{nil, nil, nil},
+			expected: []blockchain.Transaction{txs[1], txs[2]},
+		},
+		{
+			name:     "rejects lowest fee when count is full",
+			maxCount: 2,
+			maxBytes: 1 << 20,
+			add:      []blockchain.Transaction{txs[0], txs[1], cheap},
+			errs:     []error{nil, nil, txpool.ErrFeeTooLow},
+			expected: []blockchain.Transaction{txs[0], txs[1]},
+		},
+		{
+			name:     "evicts several when bytes are full",
+			maxCount: 10,
+			maxBytes: 2*size + large.Size() - 1,
+			add:      []blockchain.Transaction{txs[0], txs[1], txs[2], large},
+			errs:     []error{nil, nil, nil, nil},
+			expected: []blockchain.Transaction{txs[2], large},
+		},
+		{
+			name:     "fee rate wins over fee",
+			maxCount: 2,
+			maxBytes: 1 << 20,
+			add:      []blockchain.Transaction{txs[0], txs[1], padded},
+			errs:     []error{nil, nil, txpool.ErrFeeTooLow},
+			expected: []blockchain.Transaction{txs[0], txs[1]},
+		},
+		{
+			name:     "larger than the pool",
+			maxCount: 10,
+			maxBytes: size - 1,
+			add:      []blockchain.Transaction{txs[0]},
+			errs:     []error{txpool.ErrTransactionTooLarge},
+			expected: []blockchain.Transaction{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := newTestState(sender, cheapSender, paddedSender, largeSender)
+			p := txpool.NewPool(blockchain.NewTestParams(), state, tt.maxCount, tt.maxBytes, time.Hour)
+
+			for i, tx := range tt.add {
+				if err := p.Add(tx); !errors.Is(err, tt.errs[i]) {
+					t.Errorf("Add %d should return %v, not %v", i, tt.errs[i], err)
+				}
+			}
+
+			assertPoolHashes(t, p, tt.expected...)
+		})
+	}
+}
+
+func TestPoolRemoveConfirmed(t *testing.T) {
+	sender := blockchain.MustGenerateTestAddress(t)
+	receiver := blockchain.MustGenerateTestAddress(t)
+	miner := blockchain.MustGenerateTestAddress(t)
+
+	_, genesis := blockchain.MustCreateTestLedger(t)
+
+	confirmed := sender.NewTransaction(receiver.PublicKey(), 1, 0, 0)
+	pending := sender.NewTransaction(receiver.PublicKey(), 1, 0, 1)
+	b := blockchain.NewTestBlock(t, genesis, []blockchain.Transaction{confirmed}, 0, miner.PublicKey())
+
+	p := newTestPool(newTestState(sender))
+	p.Add(confirmed)
+	p.Add(pending)
+
+	if n := p.RemoveConfirmed(b); n != 1 {
+		t.Errorf("expected 1 transaction removed; got %d", n)
+	}
+	assertPoolHashes(t, p, pending)
+
+	if n := p.RemoveConfirmed(b); n != 0 {
+		t.Errorf("expected nothing removed; got %d", n)
+	}
+}
+
+func TestPoolReorg(t *testing.T) {
+	sender := blockchain.MustGenerateTestAddress(t)
+	receiver := blockchain.MustGenerateTestAddress(t)
+	minerA := blockchain.MustGenerateTestAddress(t)
+	minerB := blockchain.MustGenerateTestAddress(t)
+
+	_, genesis := blockchain.MustCreateTestLedger(t)
+
+	txInBoth := sender.NewTransaction(receiver.PublicKey(), 1, 0, 0)
+	txInA := sender.NewTransaction(receiver.PublicKey(), 1, 0, 1)
+	txInB := sender.NewTransaction(receiver.PublicKey(), 1, 0, 2)
+	txPending := sender.NewTransaction(receiver.PublicKey(), 1, 0, 3)
+
+	blockA := blockchain.NewTestBlock(t, genesis, []blockchain.Transaction{txInBoth, txInA}, 0, minerA.PublicKey())
+	blockB := blockchain.NewTestBlock(t, genesis, []blockchain.Transaction{txInBoth, txInB}, 0, minerB.PublicKey())
+
+	p := newTestPool(newTestState(sender))
+	p.Add(txInB)
+	p.Add(txPending)
+	p.Add(txInA) // already in the pool, shouldn't be added twice
+
+	// The order the ledger publishes a switch from A to B in
+	p.Restore(blockA)
+	p.RemoveConfirmed(blockB)
+
+	assertPoolHashes(t, p, txInA, txPending)
+}
+
+func TestPoolSenderChecks(t *testing.T) {
+	sender := blockchain.MustGenerateTestAddress(t)
+	receiver := blockchain.MustGenerateTestAddress(t)
+
+	pending := sender.NewTransaction(receiver.PublicKey(), 60, 0, 2)
+
+	tests := []struct {
+		name    string
+		tx      blockchain.Transaction
+		wantErr error
+	}{
+		{"next nonce", sender.NewTransaction(receiver.PublicKey(), 30, 10, 1), nil},
+		{"future nonce", sender.NewTransaction(receiver.PublicKey(), 30, 10, 5), nil},
+		{"furthest future nonce", sender.NewTransaction(receiver.PublicKey(), 30, 10, txpool.MaxNonceGap), nil},
+		{"nonce too far ahead", sender.NewTransaction(receiver.PublicKey(), 30, 10, 1+txpool.MaxNonceGap), txpool.ErrNonceTooHigh},
+		{"used nonce", sender.NewTransaction(receiver.PublicKey(), 1, 0, 0), txpool.ErrNonceTooLow},
+		{"pending nonce", sender.NewTransaction(receiver.PublicKey(), 1, 0, 2), txpool.ErrReplacementTooCheap},
+		{"unaffordable with pending", sender.NewTransaction(receiver.PublicKey(), 30, 11, 1), txpool.ErrInsufficientBalance},
+		{"unfunded sender", receiver.NewTransaction(sender.PublicKey(), 1, 0, 0), txpool.ErrInsufficientBalance},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := newTestState()
+			state.balances[string(sender.PublicKey())] = 100
+			state.nonces[string(sender.PublicKey())] = 1
+
+			p := newTestPool(state)
+			if err := p.Add(pending); err != nil {
+				t.Fatalf("Add should not return an error: %v", err)
+			}
+
+			if err := p.Add(tt.tx); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Add should return %v, not %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestPoolReplace(t *testing.T) {
+	sender := blockchain.MustGenerateTestAddress(t)
+	receiver := blockchain.MustGenerateTestAddress(t)
+
+	tests := []struct {
+		name     string
+		oldFee   uint64
+		value    uint64
+		fee      uint64
+		maxCount int
+		wantErr  error
+	}{
+		{"exact bump", 10, 2, 11, 10, nil},
+		{"bump rounds up", 15, 2, 17, 10, nil},
+		{"bump too small", 15, 2, 16, 10, txpool.ErrReplacementTooCheap},
+		{"same fee", 10, 2, 10, 10, txpool.ErrReplacementTooCheap},
+		{"lower fee", 10, 2, 5, 10, txpool.ErrReplacementTooCheap},
+		{"replacing no fee", 0, 2, 1, 10, nil},
+		{"huge fee", math.MaxUint64 / 2, 0, math.MaxUint64 - 100, 10, nil},
+		{"only the replaced payment is counted", 10, 80, 20, 10, nil},
+		{"unaffordable", 10, 81, 20, 10, txpool.ErrInsufficientBalance},
+		{"full pool", 10, 2, 11, 2, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := newTestState()
+			state.balances[string(sender.PublicKey())] = math.MaxUint64
+
+			// The other transaction leaves 100 for the nonce being replaced
+			if tt.oldFee < math.MaxUint64/4 {
+				state.balances[string(sender.PublicKey())] = 110
+			}
+
+			p := txpool.NewPool(blockchain.NewTestParams(), state, tt.maxCount, 1<<20, time.Hour)
+			other := sender.NewTransaction(receiver.PublicKey(), 10, 0, 0)
+			old := sender.NewTransaction(receiver.PublicKey(), 1, tt.oldFee, 1)
+			for _, tx := range []blockchain.Transaction{other, old} {
+				if err := p.Add(tx); err != nil {
+					t.Fatalf("Add should not return an error: %v", err)
+				}
+			}
+
+			replacement := sender.NewTransaction(receiver.PublicKey(), tt.value, tt.fee, 1)
+			if err := p.Add(replacement); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Add should return %v, not %v", tt.wantErr, err)
+			}
+
+			if tt.wantErr != nil {
+				assertPoolHashes(t, p, other, old)
+				return
+			}
+			assertPoolHashes(t, p, other, replacement)
+			if p.Bytes() != other.Size()+replacement.Size() {
+				t.Errorf("expected pool of %d bytes; got %d", other.Size()+replacement.Size(), p.Bytes())
+			}
+			if txs := p.Snapshot(); len(txs) != 2 {
+				t.Errorf("replacement should be ready, got %d ready transactions", len(txs))
+			}
+		})
+	}
+}
+
+func TestPoolParked(t *testing.T) {
+	sender := blockchain.MustGenerateTestAddress(t)
+	receiver := blockchain.MustGenerateTestAddress(t)
+
+	tx0 := sender.NewTransaction(receiver.PublicKey(), 1, 0, 0)
+	tx1 := sender.NewTransaction(receiver.PublicKey(), 1, 0, 1)
+	tx2 := sender.NewTransaction(receiver.PublicKey(), 1, 0, 2)
+
+	p := newTestPool(newTestState(sender))
+	p.Add(tx2)
+	p.Add(tx1)
+
+	if txs := p.Snapshot(); len(txs) != 0 {
+		t.Errorf("transactions after a missing nonce should be parked, got %d", len(txs))
+	}
+
+	p.Add(tx0)
+	if txs := p.Snapshot(); len(txs) != 3 {
+		t.Errorf("filling the gap should make every transaction ready, got %d", len(txs))
+	}
+
+	// Removing a nonce parks the ones after it again
+	p.Remove(tx1.Hash())
+	if txs := p.Snapshot(); len(txs) != 1 || txs[0].Hash() != tx0.Hash() {
+		t.Errorf("only the transaction before the gap should be ready, got %d", len(txs))
+	}
+	assertPoolHashes(t, p, tx0, tx2)
+}
+
+func TestPoolEvictsParkedFirst(t *testing.T) {
+	sender := blockchain.MustGenerateTestAddress(t)
+	other := blockchain.MustGenerateTestAddress(t)
+	receiver := blockchain.MustGenerateTestAddress(t)
+
+	ready := sender.NewTransaction(receiver.PublicKey(), 1, 1, 0)
+	next := sender.NewTransaction(receiver.PublicKey(), 1, 100, 1)
+	parked := sender.NewTransaction(receiver.PublicKey(), 1, 100, 2)
+	cheap := other.NewTransaction(receiver.PublicKey(), 1, 2, 0)
+	free := other.NewTransaction(receiver.PublicKey(), 1, 0, 0)
+
+	p := txpool.NewPool(blockchain.NewTestParams(), newTestState(sender, other), 2, 1<<20, time.Hour)
+	p.Add(ready)
+	p.Add(parked)
+
+	// Despite paying less, a transaction which can be mined now wins
+	if err := p.Add(cheap); err != nil {
+		t.Fatalf("Add should not return an error: %v", err)
+	}
+	assertPoolHashes(t, p, ready, cheap)
+
+	// A parked transaction can't take the place of a ready one
+	if err := p.Add(parked); !errors.Is(err, txpool.ErrFeeTooLow) {
+		t.Errorf("Add should return %v, not %v", txpool.ErrFeeTooLow, err)
+	}
+	assertPoolHashes(t, p, ready, cheap)
+
+	// Once its gap is filled, it is only evicted for its fee rate
+	p = txpool.NewPool(blockchain.NewTestParams(), newTestState(sender, other), 2, 1<<20, time.Hour)
+	p.Add(next)
+	p.Add(ready)
+	if err := p.Add(free); !errors.Is(err, txpool.ErrFeeTooLow) {
+		t.Errorf("Add should return %v, not %v", txpool.ErrFeeTooLow, err)
+	}
+	assertPoolHashes(t, p, ready, next)
+}
+
+func TestPoolRevalidate(t *testing.T) {
+	sender := blockchain.MustGenerateTestAddress(t)
+	receiver := blockchain.MustGenerateTestAddress(t)
+
+	tx0 := sender.NewTransaction(receiver.PublicKey(), 10, 0, 0)
+	tx1 := sender.NewTransaction(receiver.PublicKey(), 10, 0, 1)
+	tx2 := sender.NewTransaction(receiver.PublicKey(), 10, 0, 2)
+	tx4 := sender.NewTransaction(receiver.PublicKey(), 10, 0, 4)
+
+	tests := []struct {
+		name     string
+		balance  uint64
+		nonce    uint64
+		dropped  int
+		ready    int
+		expected []blockchain.Transaction
+	}{
+		{"unchanged", 100, 0, 0, 3, []blockchain.Transaction{tx0, tx1, tx2, tx4}},
+		{"nonces confirmed", 100, 2, 2, 1, []blockchain.Transaction{tx2, tx4}},
+		{"gap confirmed", 100, 4, 3, 1, []blockchain.Transaction{tx4}},
+		{"balance spent elsewhere", 25, 0, 2, 2, []blockchain.Transaction{tx0, tx1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := newTestState(sender)
+			p := newTestPool(state)
+			for _, tx := range []blockchain.Transaction{tx0, tx1, tx2, tx4} {
+				if err := p.Add(tx); err != nil {
+					t.Fatalf("Add should not return an error: %v", err)
+				}
+			}
+
+			state.balances[string(sender.PublicKey())] = tt.balance
+			state.nonces[string(sender.PublicKey())] = tt.nonce
+
+			if dropped := p.Revalidate(); dropped != tt.dropped {
+				t.Errorf("expected %d transactions dropped; got %d", tt.dropped, dropped)
+			}
+			if ready := len(p.Snapshot()); ready != tt.ready {
+				t.Errorf("expected %d transactions ready; got %d", tt.ready, ready)
+			}
+			assertPoolHashes(t, p, tt.expected...)
+		})
+	}
+}
+
+func TestPoolConcurrent(t *testing.T) {
+	receiver := blockchain.MustGenerateTestAddress(t)
+
+	const txsPerSender = 50
+	senders := make([]blockchain.Address, 4)
+	txs := make([][]blockchain.Transaction, len(senders))
+	for i := range senders {
+		senders[i] = blockchain.MustGenerateTestAddress(t)
+		for n := range txsPerSender {
+			txs[i] = append(txs[i], senders[i].NewTransaction(receiver.PublicKey(), 1, uint64(n%7), uint64(n)))
+		}
+	}
+
+	p := txpool.NewPool(blockchain.NewTestParams(), newTestState(senders...), len(senders)*txsPerSender, 1<<20, time.Hour)
+	var wg sync.WaitGroup
+
+	for i := range senders {
+		wg.Go(func() {
+			for _, tx := range txs[i] {
+				if err := p.Add(tx); err != nil {
+					t.Errorf("Add should not return an error: %v", err)
+				}
+			}
+		})
+	}
+
+	// The first sender's transactions are removed as they arrive
+	wg.Go(func() {
+		for removed := 0; removed < txsPerSender; {
+			if p.Remove(txs[0][removed].Hash()) {
+				removed++
+			}
+		}
+	})
+
+	for range 2 {
+		wg.Go(func() {
+			for range 100 {
+				// Each sender's ready transactions must follow on from their
+				// confirmed nonce, or the snapshot was taken mid-change
+				snapshot := p.Snapshot()
+				ready := map[string]int{}
+				for _, tx := range snapshot {
+					ready[string(tx.Sender)]++
+				}
+				for _, tx := range snapshot {
+					if tx.Nonce >= uint64(ready[string(tx.Sender)]) {
+						t.Errorf("transaction with nonce %d is ready after a gap", tx.Nonce)
+						return
+					}
+				}
+			}
+		})
+	}
+
+	wg.Wait()
+
+	assertPoolHashes(t, p, append(append(txs[1], txs[2]...), txs[3]...)...)
+	bytes := 0
+	for _, tx := range p.Snapshot() {
+		bytes += tx.Size()
+	}
+	if p.Bytes() != bytes {
+		t.Errorf("expected pool of %d bytes; got %d", bytes, p.Bytes())
+	}
+}
+
+func TestPoolSubscribe(t *testing.T) {
+	sender := blockchain.MustGenerateTestAddress(t)
+	receiver := blockchain.MustGenerateTestAddress(t)
+	miner := blockchain.MustGenerateTestAddress(t)
+
+	_, genesis := blockchain.MustCreateTestLedger(t)
+
+	params := blockchain.NewTestParams()
+	params.MaxBlockTransactions = 3 // A coinbase and 2 transactions
+	p := txpool.NewPool(params, newTestState(sender), 100, 1<<20, time.Hour)
+
+	var notified []blockchain.Transaction
+	unsubscribe := p.Subscribe(func(tx blockchain.Transaction) {
+		notified = append(notified, tx)
+	})
+
+	first := sender.NewTransaction(receiver.PublicKey(), 1, 5, 0)
+	second := sender.NewTransaction(receiver.PublicKey(), 1, 5, 1)
+	cheap := sender.NewTransaction(receiver.PublicKey(), 1, 1, 2)
+	parked := sender.NewTransaction(receiver.PublicKey(), 1, 50, 5)
+	expensive := sender.NewTransaction(receiver.PublicKey(), 1, 10, 3)
+	restored := sender.NewTransaction(receiver.PublicKey(), 1, 20, 4)
+
+	for _, tx := range []blockchain.Transaction{first, second, cheap, parked, expensive} {
+		if err := p.Add(tx); err != nil {
+			t.Fatalf("Add should not return an error: %v", err)
+		}
+	}
+	// Mining restarts on the new head anyway
+	p.Restore(blockchain.NewTestBlock(t, genesis, []blockchain.Transaction{restored}, 0, miner.PublicKey()))
+
+	// The cheap transaction doesn't make the block, and the parked one can't
+	expected := []blockchain.Transaction{first, second, expensive}
+	if len(notified) != len(expected) {
+		t.Fatalf("expected %d notifications; got %d", len(expected), len(notified))
+	}
+	for i, tx := range notified {
+		if tx.Hash() != expected[i].Hash() {
+			t.Errorf("notification %d should be for nonce %d, not %d", i, expected[i].Nonce, tx.Nonce)
+		}
+	}
+
+	unsubscribe()
+	p.Add(sender.NewTransaction(receiver.PublicKey(), 1, 100, 6))
+	if len(notified) != len(expected) {
+		t.Error("unsubscribed function should not be called")
+	}
+}
+
+func TestPoolExpiry(t *testing.T) {
+	sender := blockchain.MustGenerateTestAddress(t)
+	other := blockchain.MustGenerateTestAddress(t)
+	receiver := blockchain.MustGenerateTestAddress(t)
+
+	now := time.Now()
+	p := newTestPool(newTestState(sender, other))
+	p.SetClock(func() time.Time { return now })
+
+	old0 := sender.NewTransaction(receiver.PublicKey(), 1, 0, 0)
+	old1 := sender.NewTransaction(receiver.PublicKey(), 1, 0, 1)
+	p.Add(old0)
+	p.Add(old1)
+
+	now = now.Add(30 * time.Minute)
+	recent := sender.NewTransaction(receiver.PublicKey(), 1, 0, 2)
+	p.Add(recent)
+
+	now = now.Add(31 * time.Minute)
+	if dropped := p.Revalidate(); dropped != 2 {
+		t.Errorf("expected 2 transactions dropped; got %d", dropped)
+	}
+	assertPoolHashes(t, p, recent)
+	if txs := p.Snapshot(); len(txs) != 0 {
+		t.Error("transaction after an expired nonce should be parked")
+	}
+
+	// Adding is enough to expire the rest
+	now = now.Add(time.Hour)
+	fresh := other.NewTransaction(receiver.PublicKey(), 1, 0, 0)
+	if err := p.Add(fresh); err != nil {
+		t.Fatalf("Add should not return an error: %v", err)
+	}
+	assertPoolHashes(t, p, fresh)
+
+	// As is taking a snapshot to mine from
+	now = now.Add(2 * time.Hour)
+	if txs := p.Snapshot(); len(txs) != 0 {
+		t.Errorf("expired transaction should not be in the snapshot, got %d", len(txs))
+	}
+	if p.Size() != 0 {
+		t.Errorf("snapshot should drop expired transactions, %d left", p.Size())
+	}
+}
+
+func TestPoolSaveLoad(t *testing.T) {
+	sender := blockchain.MustGenerateTestAddress(t)
+	receiver := blockchain.MustGenerateTestAddress(t)
+
+	now := time.Now()
+	path := filepath.Join(t.TempDir(), "mempool.json")
+
+	confirmed := sender.NewTransaction(receiver.PublicKey(), 1, 0, 0)
+	old := sender.NewTransaction(receiver.PublicKey(), 1, 0, 1)
+	recent := sender.NewTransaction(receiver.PublicKey(), 1, 0, 2)
+	parked := sender.NewTransaction(receiver.PublicKey(), 1, 0, 4)
+
+	p := newTestPool(newTestState(sender))
+	p.SetClock(func() time.Time { return now })
+	p.Add(confirmed)
+	p.Add(old)
+	now = now.Add(30 * time.Minute)
+	p.Add(recent)
+	p.Add(parked)
+
+	if err := p.Save(path); err != nil {
+		t.Fatalf("Save should not return an error: %v", err)
+	}
+
+	// While the node was down, the first transaction was mined
+	state := newTestState(sender)
+	state.nonces[string(sender.PublicKey())] = 1
+
+	loaded := newTestPool(state)
+	loaded.SetClock(func() time.Time { return now })
+	n, err := loaded.Load(path)
+	if err != nil {
+		t.Fatalf("Load should not return an error: %v", err)
+	}
+	if n != 3 {
+		t.Errorf("expected 3 transactions loaded; got %d", n)
+	}
+	assertPoolHashes(t, loaded, old, recent, parked)
+	if txs := loaded.Snapshot(); len(txs) != 2 {
+		t.Errorf("expected 2 transactions ready; got %d", len(txs))
+	}
+
+	// The time each arrived is kept, so they expire as if never reloaded
+	now = now.Add(31 * time.Minute)
+	loaded.Revalidate()
+	assertPoolHashes(t, loaded, recent, parked)
+
+	if n, err := newTestPool(state).Load(filepath.Join(t.TempDir(), "missing.json")); n != 0 || err != nil {
+		t.Errorf("missing file should load nothing, got %d and %v", n, err)
+	}
+
+	if err := os.WriteFile(path, []byte("steve"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newTestPool(state).Load(path); err == nil {
+		t.Error("Load should return an error for a corrupt file")
+	}
+}